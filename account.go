@@ -0,0 +1,281 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+var (
+	// AccountConflict is the error class for logins with a provider identity
+	// that isn't linked to the account the user is logged in as. See
+	// (*ProviderGroup).AttachURL.
+	AccountConflict = wherr.Forbidden.NewClass(
+		"identity linked to another account")
+
+	// InvalidAttach is the error class for attach logins with a token that
+	// AttachURL didn't issue to the user's session, or that was already used.
+	InvalidAttach = wherr.Forbidden.NewClass("invalid attach token")
+
+	// NoSubject is the error class for logins that can't be linked to an
+	// account because the provider didn't say who the user is.
+	NoSubject = wherr.BadGateway.NewClass("provider gave no subject")
+)
+
+// IdentityStore maps provider identities, a provider name and the
+// provider's subject for the user, to application account IDs. An account
+// can have any number of identities, but an identity belongs to at most one
+// account.
+type IdentityStore interface {
+	// Lookup returns the account the identity is linked to, or "" if it
+	// isn't linked.
+	Lookup(ctx context.Context, provider, subject string) (string, error)
+
+	// Create makes a new account and links the identity to it. It should
+	// fail with an AccountConflict error if the identity is already linked.
+	Create(ctx context.Context, provider, subject string) (string, error)
+
+	// Link links the identity to account. It should fail with an
+	// AccountConflict error if the identity is linked to another account.
+	Link(ctx context.Context, account, provider, subject string) error
+
+	// Unlink removes the identity from account.
+	Unlink(ctx context.Context, account, provider, subject string) error
+}
+
+// SetIdentityStore turns on account linking. Every login then looks up the
+// account the provider identity is linked to, creating one if there is
+// none. Identities are only linked to an existing account through an
+// AttachURL, while the user is logged in to that account. Logins with
+// identities that aren't linked to the account the user is already logged
+// in as fail with an AccountConflict error; the user has to log out first.
+// See Account.
+func (g *ProviderGroup) SetIdentityStore(store IdentityStore) {
+	g.identities = store
+}
+
+// Account returns the account ID the user is logged in as, or "" if the user
+// isn't logged in or no IdentityStore is set. For requests authenticated by
+// BearerRequired, it's the account the bearer token's identity is linked to.
+func (g *ProviderGroup) Account(ctx context.Context) (string, error) {
+	if g.identities == nil {
+		return "", nil
+	}
+	for _, handler := range g.handlers {
+		if id, ok := handler.bearerIdentity(ctx); ok {
+			if id.Subject == "" {
+				return "", nil
+			}
+			return g.identities.Lookup(ctx, id.Provider, id.Subject)
+		}
+	}
+	session, err := g.Session(ctx)
+	if err != nil {
+		return "", err
+	}
+	return g.account(ctx, session)
+}
+
+// account returns the account from the group session if the user is still
+// logged in with some provider.
+func (g *ProviderGroup) account(ctx context.Context,
+	session *whsess.Session) (string, error) {
+	account, ok := session.Values["_account"].(string)
+	if !ok || account == "" {
+		return "", nil
+	}
+	logged_in, err := g.LoggedIn(ctx)
+	if err != nil || !logged_in {
+		return "", err
+	}
+	return account, nil
+}
+
+// maxAttachTokens bounds how many unused attach tokens a session keeps. The
+// oldest is dropped first.
+const maxAttachTokens = 8
+
+// attachURL returns a login URL that attaches the identity to the user's
+// account, with a new attach token saved to the session.
+func (o *ProviderHandler) attachURL(ctx context.Context, w http.ResponseWriter,
+	redirect_to string) (string, error) {
+	session, err := o.Session(ctx)
+	if err != nil {
+		return "", err
+	}
+	token := newState()
+	tokens, _ := session.Values["_attach"].([]string)
+	if len(tokens) >= maxAttachTokens {
+		tokens = tokens[len(tokens)-maxAttachTokens+1:]
+	}
+	session.Values["_attach"] = append(append([]string(nil), tokens...), token)
+	err = session.Save(ctx, w)
+	if err != nil {
+		return "", err
+	}
+	return o.loginURL(redirect_to, true, nil, token), nil
+}
+
+// useAttachToken removes token from the session's attach tokens. It returns
+// false if the session wasn't issued token or already used it. The session
+// still needs to be saved.
+func useAttachToken(session *whsess.Session, token string) bool {
+	tokens, _ := session.Values["_attach"].([]string)
+	for i, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			session.Values["_attach"] = append(append([]string(nil),
+				tokens[:i]...), tokens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// linkIdentity checks that id may log in to the user's account. Nothing is
+// changed until the returned function is called, which creates the account or,
+// if attach is set, links id to the current account, and records the account
+// in the group session.
+func (g *ProviderGroup) linkIdentity(ctx context.Context,
+	session *whsess.Session, id *Identity, attach bool) (func() error, error) {
+	if id.Subject == "" {
+		return nil, NoSubject.New("can't link %s login to an account",
+			id.Provider)
+	}
+	current, err := g.account(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if attach {
+		if current == "" {
+			return nil, NotLoggedIn.New("can't attach %s without an account",
+				id.Provider)
+		}
+		// the callback runs before the new token is saved, so the provider's
+		// session still has whoever the user was logged in as.
+		subject, err := g.handlers[id.Provider].sessionSubject(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if subject != "" && subject != id.Subject {
+			return nil, AccountConflict.New("already logged in as %s user %s",
+				id.Provider, subject)
+		}
+	}
+	linked, err := g.identities.Lookup(ctx, id.Provider, id.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if current != "" && linked != current && (linked != "" || !attach) {
+		return nil, AccountConflict.New("%s user %s", id.Provider, id.Subject)
+	}
+	return func() error {
+		account := linked
+		var err error
+		switch {
+		case linked != "":
+		case attach:
+			err = g.identities.Link(ctx, current, id.Provider, id.Subject)
+			account = current
+		default:
+			account, err = g.createAccount(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+		session.Values["_account"] = account
+		return nil
+	}, nil
+}
+
+// createAccount makes an account for id. If a concurrent first login with the
+// same identity made one in the meantime, that account is used instead.
+func (g *ProviderGroup) createAccount(ctx context.Context,
+	id *Identity) (string, error) {
+	account, err := g.identities.Create(ctx, id.Provider, id.Subject)
+	if !AccountConflict.Contains(err) {
+		return account, err
+	}
+	linked, lookup_err := g.identities.Lookup(ctx, id.Provider, id.Subject)
+	if lookup_err != nil {
+		return "", lookup_err
+	}
+	if linked == "" {
+		return "", err
+	}
+	return linked, nil
+}
+
+// MemoryIdentityStore is an IdentityStore that keeps links in memory, mostly
+// useful for tests and prototypes. Accounts are numbered from 1.
+type MemoryIdentityStore struct {
+	mtx      sync.Mutex
+	last     int64
+	accounts map[memoryIdentity]string
+}
+
+type memoryIdentity struct {
+	provider, subject string
+}
+
+// NewMemoryIdentityStore makes an empty MemoryIdentityStore.
+func NewMemoryIdentityStore() *MemoryIdentityStore {
+	return &MemoryIdentityStore{accounts: make(map[memoryIdentity]string)}
+}
+
+// Lookup implements IdentityStore
+func (s *MemoryIdentityStore) Lookup(ctx context.Context,
+	provider, subject string) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.accounts[memoryIdentity{provider, subject}], nil
+}
+
+// Create implements IdentityStore
+func (s *MemoryIdentityStore) Create(ctx context.Context,
+	provider, subject string) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := memoryIdentity{provider, subject}
+	if account, exists := s.accounts[key]; exists {
+		return "", AccountConflict.New("%s user %s is linked to %s",
+			provider, subject, account)
+	}
+	s.last++
+	account := strconv.FormatInt(s.last, 10)
+	s.accounts[key] = account
+	return account, nil
+}
+
+// Link implements IdentityStore
+func (s *MemoryIdentityStore) Link(ctx context.Context,
+	account, provider, subject string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := memoryIdentity{provider, subject}
+	if linked, exists := s.accounts[key]; exists && linked != account {
+		return AccountConflict.New("%s user %s is linked to %s",
+			provider, subject, linked)
+	}
+	s.accounts[key] = account
+	return nil
+}
+
+// Unlink implements IdentityStore
+func (s *MemoryIdentityStore) Unlink(ctx context.Context,
+	account, provider, subject string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := memoryIdentity{provider, subject}
+	if s.accounts[key] == account {
+		delete(s.accounts, key)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+	"gopkg.in/webhelp.v1/whcompat"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+// groupApp is an application with account linking for two providers, "a"
+// and "b", each backed by its own whoauth2test.Server. The group is mounted
+// at /auth, and every other page shows the user's account.
+type groupApp struct {
+	*httptest.Server
+	idps  map[string]*whoauth2test.Server
+	group *whoauth2.ProviderGroup
+	mux   *http.ServeMux
+
+	mtx       sync.Mutex
+	login_err error
+	successes int
+	reject    string
+}
+
+func newGroupApp(t *testing.T) *groupApp {
+	identities := []whoauth2test.Identity{
+		{Subject: "alice"}, {Subject: "bob"}, {Subject: "carol"}}
+	app := &groupApp{idps: map[string]*whoauth2test.Server{
+		"a": whoauth2test.NewServer(identities...),
+		"b": whoauth2test.NewServer(identities...)},
+		mux: http.NewServeMux()}
+	app.Server = httptest.NewServer(whsess.HandlerWithStore(
+		whsess.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")),
+		app.mux))
+	var err error
+	app.group, err = whoauth2.NewProviderGroup("oauth", "/auth",
+		whoauth2.RedirectURLs{},
+		app.idps["a"].Provider("a", app.URL+"/auth/a/_cb"),
+		app.idps["b"].Provider("b", app.URL+"/auth/b/_cb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.group.SetIdentityStore(whoauth2.NewMemoryIdentityStore())
+	app.group.SetHooks(whoauth2.Hooks{
+		OnLoginSuccess: func(ctx context.Context, provider *whoauth2.Provider,
+			id *whoauth2.Identity, redirect_to string) (string, error) {
+			app.mtx.Lock()
+			defer app.mtx.Unlock()
+			if provider.Name == app.reject {
+				return "", errors.New("rejected")
+			}
+			app.successes++
+			return redirect_to, nil
+		},
+		OnLoginError: func(w http.ResponseWriter, r *http.Request,
+			provider *whoauth2.Provider, err error) {
+			app.mtx.Lock()
+			app.login_err = err
+			app.mtx.Unlock()
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}})
+	app.mux.Handle("/auth/", http.StripPrefix("/auth", app.group))
+	app.mux.HandleFunc("/attach", func(w http.ResponseWriter, r *http.Request) {
+		attach_url, err := app.group.AttachURL(whcompat.Context(r), w,
+			r.FormValue("provider"), "/")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, attach_url, http.StatusSeeOther)
+	})
+	app.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		account, err := app.group.Account(whcompat.Context(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "account %#v", account)
+	})
+	return app
+}
+
+func (app *groupApp) Close() {
+	app.Server.Close()
+	for _, idp := range app.idps {
+		idp.Close()
+	}
+}
+
+// user returns a browser with no cookies yet.
+func (app *groupApp) user() *whoauth2test.User {
+	return app.idps["a"].User("")
+}
+
+// visit has user log in to provider as subject through login_url, and
+// returns the account the user ends up with and the error the login failed
+// with, if any.
+func (app *groupApp) visit(t *testing.T, user *whoauth2test.User, provider,
+	subject, login_url string) (string, error) {
+	idp_url, err := url.Parse(app.idps[provider].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Jar.SetCookies(idp_url, []*http.Cookie{{
+		Name: whoauth2test.SubjectCookie, Value: subject}})
+	app.mtx.Lock()
+	app.login_err = nil
+	app.mtx.Unlock()
+	_, _, err = fetch(user.Client, app.URL+login_url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := fetch(user.Client, app.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	return body, app.login_err
+}
+
+func (app *groupApp) login(t *testing.T, user *whoauth2test.User, provider,
+	subject string) (string, error) {
+	return app.visit(t, user, provider, subject,
+		app.group.LoginURL(provider, "/", true))
+}
+
+func (app *groupApp) attach(t *testing.T, user *whoauth2test.User, provider,
+	subject string) (string, error) {
+	return app.visit(t, user, provider, subject, "/attach?provider="+provider)
+}
+
+func TestAccountLinking(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+
+	user := app.user()
+	if account, err := app.login(t, user, "a", "alice"); err != nil ||
+		account != `account "1"` {
+		t.Fatalf("first login: got %s, %v", account, err)
+	}
+	// logging in with an unlinked identity doesn't link it.
+	account, err := app.login(t, user, "b", "bob")
+	if !whoauth2.AccountConflict.Contains(err) || account != `account "1"` {
+		t.Fatalf("unlinked login: got %s, %v", account, err)
+	}
+	if account, err := app.attach(t, user, "b", "bob"); err != nil ||
+		account != `account "1"` {
+		t.Fatalf("attach: got %s, %v", account, err)
+	}
+
+	// the linked identity logs in to the same account from a new browser.
+	other := app.user()
+	if account, err := app.login(t, other, "b", "bob"); err != nil ||
+		account != `account "1"` {
+		t.Fatalf("linked login: got %s, %v", account, err)
+	}
+
+	// an identity of another account can't be attached.
+	if account, err := app.login(t, app.user(), "b", "carol"); err != nil ||
+		account != `account "2"` {
+		t.Fatalf("second account: got %s, %v", account, err)
+	}
+	_, err = app.attach(t, user, "b", "carol")
+	if !whoauth2.AccountConflict.Contains(err) {
+		t.Fatalf("attaching a linked identity: got %v", err)
+	}
+}
+
+func TestAccountAttachLoggedIn(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+
+	user := app.user()
+	if _, err := app.login(t, user, "a", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// someone else's identity with a provider the user is logged in with
+	// isn't attached to the user's account.
+	account, err := app.attach(t, user, "a", "carol")
+	if !whoauth2.AccountConflict.Contains(err) || account != `account "1"` {
+		t.Fatalf("got %s, %v", account, err)
+	}
+	if account, err := app.login(t, app.user(), "a", "carol"); err != nil ||
+		account != `account "2"` {
+		t.Fatalf("carol's login: got %s, %v", account, err)
+	}
+
+	// attaching needs an account to attach to.
+	_, err = app.attach(t, app.user(), "b", "bob")
+	if !whoauth2.NotLoggedIn.Contains(err) {
+		t.Fatalf("attach without an account: got %v", err)
+	}
+}
+
+func TestAccountLinkingBeforeHook(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+
+	user := app.user()
+	if _, err := app.login(t, user, "a", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := app.login(t, user, "b", "bob")
+	if !whoauth2.AccountConflict.Contains(err) {
+		t.Fatalf("got %v", err)
+	}
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	if app.successes != 1 {
+		t.Fatalf("OnLoginSuccess called %d times", app.successes)
+	}
+}
+
+func TestAccountAttachRejected(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+
+	user := app.user()
+	if _, err := app.login(t, user, "a", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	app.mtx.Lock()
+	app.reject = "b"
+	app.mtx.Unlock()
+	if account, err := app.attach(t, user, "b", "bob"); err == nil ||
+		account != `account "1"` {
+		t.Fatalf("rejected attach: got %s, %v", account, err)
+	}
+	app.mtx.Lock()
+	app.reject = ""
+	app.mtx.Unlock()
+
+	// the rejected identity wasn't linked, so it gets an account of its own.
+	if account, err := app.login(t, app.user(), "b", "bob"); err != nil ||
+		account != `account "2"` {
+		t.Fatalf("after rejected attach: got %s, %v", account, err)
+	}
+}
+
+func TestAccountAttachToken(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+
+	user := app.user()
+	if _, err := app.login(t, user, "a", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// a link that just asks for attach mode, such as one on another site,
+	// doesn't attach anything.
+	account, err := app.visit(t, user, "b", "bob",
+		app.group.LoginURL("b", "/", false)+"&attach=true")
+	if !whoauth2.InvalidAttach.Contains(err) || account != `account "1"` {
+		t.Fatalf("bare attach link: got %s, %v", account, err)
+	}
+
+	// attach links only work once.
+	client := &http.Client{Jar: user.Jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	resp, err := client.Get(app.URL + "/attach?provider=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	attach_url := resp.Header.Get("Location")
+	if !strings.Contains(attach_url, "force_prompt=true") {
+		t.Fatalf("got attach url %#v", attach_url)
+	}
+	if account, err := app.visit(t, user, "b", "bob", attach_url); err != nil ||
+		account != `account "1"` {
+		t.Fatalf("attach: got %s, %v", account, err)
+	}
+	_, err = app.visit(t, user, "b", "bob", attach_url)
+	if !whoauth2.InvalidAttach.Contains(err) {
+		t.Fatalf("reused attach link: got %v", err)
+	}
+
+	// nor do they work for anyone else.
+	other := app.user()
+	if _, err := app.login(t, other, "a", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Get(app.URL + "/attach?provider=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	account, err = app.visit(t, other, "b", "carol",
+		resp.Header.Get("Location"))
+	if !whoauth2.InvalidAttach.Contains(err) || account != `account "2"` {
+		t.Fatalf("someone else's attach link: got %s, %v", account, err)
+	}
+}
+
+// racingIdentityStore is an IdentityStore where another login always creates
+// the account first.
+type racingIdentityStore struct {
+	*whoauth2.MemoryIdentityStore
+}
+
+func (s racingIdentityStore) Create(ctx context.Context,
+	provider, subject string) (string, error) {
+	_, err := s.MemoryIdentityStore.Create(ctx, provider, subject)
+	if err != nil {
+		return "", err
+	}
+	return s.MemoryIdentityStore.Create(ctx, provider, subject)
+}
+
+func TestAccountConcurrentFirstLogin(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+	app.group.SetIdentityStore(racingIdentityStore{
+		whoauth2.NewMemoryIdentityStore()})
+
+	if account, err := app.login(t, app.user(), "a", "alice"); err != nil ||
+		account != `account "1"` {
+		t.Fatalf("got %s, %v", account, err)
+	}
+}
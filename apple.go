@@ -0,0 +1,176 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	appleURL = "https://appleid.apple.com"
+
+	// appleSecretLifetime is how long minted client secrets are valid. Apple
+	// allows up to six months.
+	appleSecretLifetime = 24 * time.Hour
+
+	// appleSecretRenewal is how long before expiry a secret is replaced.
+	appleSecretRenewal = time.Hour
+)
+
+// Apple returns a provider for Sign in with Apple in OIDC mode. conf's
+// ClientID is the Services ID, and its ClientSecret is ignored: client
+// secrets are JWTs that are minted from the team ID, the key ID and the
+// ES256 private key from the Apple developer account, and renewed before
+// they expire. Apple posts the callback (response_mode=form_post), and sends
+// the user's name only on the first login, so applications that need it
+// should store it from the Identity's UserInfo in Hooks.OnLoginSuccess. See
+// ParseAppleKey.
+func Apple(conf Config, team_id, key_id string,
+	key *ecdsa.PrivateKey) *Provider {
+	if conf.Endpoint.AuthURL == "" {
+		conf.Endpoint = oauth2.Endpoint{
+			AuthURL:   appleURL + "/auth/authorize",
+			TokenURL:  appleURL + "/auth/token",
+			AuthStyle: oauth2.AuthStyleInParams}
+	}
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"name", "email"}
+	}
+	secret := &appleSecret{
+		team_id:   team_id,
+		key_id:    key_id,
+		client_id: conf.ClientID,
+		key:       key}
+	return &Provider{
+		Name:   "apple",
+		Config: oauth2.Config(conf),
+		OIDC:   NewOIDC(appleURL, appleURL+"/auth/keys"),
+		Revoke: RFC7009Revoker(appleURL + "/auth/revoke"),
+		AuthCodeOptions: []oauth2.AuthCodeOption{
+			oauth2.SetAuthURLParam("response_mode", "form_post")},
+		ClientSecretSource:   secret.get,
+		UserInfoFromCallback: AppleUserInfo}
+}
+
+// ParseAppleKey parses the PEM encoded private key from the .p8 file Apple
+// provides for Sign in with Apple.
+func ParseAppleKey(pem_data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pem_data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ec_key, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA key")
+	}
+	return ec_key, nil
+}
+
+// AppleUserInfo builds the user's profile from Apple's ID token claims and,
+// on the first login, the "user" form value Apple sends with the callback.
+func AppleUserInfo(r *http.Request, claims *Claims) (*UserInfo, error) {
+	if claims == nil {
+		return nil, IDTokenError.New("no id token")
+	}
+	info := &UserInfo{ID: claims.Subject, Email: claims.Email}
+	if raw_user := r.FormValue("user"); raw_user != "" {
+		var user struct {
+			Name struct {
+				FirstName string `json:"firstName"`
+				LastName  string `json:"lastName"`
+			} `json:"name"`
+			Email string `json:"email"`
+		}
+		err := json.Unmarshal([]byte(raw_user), &user)
+		if err != nil {
+			return nil, fmt.Errorf("malformed user: %v", err)
+		}
+		info.Name = strings.TrimSpace(
+			user.Name.FirstName + " " + user.Name.LastName)
+		if info.Email == "" {
+			info.Email = user.Email
+		}
+	}
+	return info, nil
+}
+
+// appleSecret mints and caches Apple client secrets.
+type appleSecret struct {
+	team_id, key_id, client_id string
+	key                        *ecdsa.PrivateKey
+
+	mtx     sync.Mutex
+	secret  string
+	expires time.Time
+}
+
+func (s *appleSecret) get(ctx context.Context) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	if s.secret != "" && now.Add(appleSecretRenewal).Before(s.expires) {
+		return s.secret, nil
+	}
+	expires := now.Add(appleSecretLifetime)
+	secret, err := signES256(s.key, map[string]string{
+		"alg": "ES256", "kid": s.key_id},
+		map[string]interface{}{
+			"iss": s.team_id,
+			"iat": now.Unix(),
+			"exp": expires.Unix(),
+			"aud": appleURL,
+			"sub": s.client_id})
+	if err != nil {
+		return "", err
+	}
+	s.secret, s.expires = secret, expires
+	return secret, nil
+}
+
+// signES256 returns a JWT with header and claims signed with key.
+func signES256(key *ecdsa.PrivateKey, header map[string]string,
+	claims map[string]interface{}) (string, error) {
+	encode := func(val interface{}) (string, error) {
+		data, err := json.Marshal(val)
+		return base64.RawURLEncoding.EncodeToString(data), err
+	}
+	encoded_header, err := encode(header)
+	if err != nil {
+		return "", err
+	}
+	encoded_claims, err := encode(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encoded_header + "." + encoded_claims
+	sum := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS signatures are the fixed size big-endian r and s, not ASN.1.
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func newAppleKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSignES256(t *testing.T) {
+	key := newAppleKey(t)
+	// about one in 128 signatures has an r or s that is shorter than 32
+	// bytes, which has to be padded to keep its place in the signature.
+	short := 0
+	for i := 0; i < 2000 && short < 3; i++ {
+		raw, err := signES256(key, map[string]string{"alg": "ES256"},
+			map[string]interface{}{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := parseJWT(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token.signature) != 64 {
+			t.Fatalf("got a %d byte signature", len(token.signature))
+		}
+		r := new(big.Int).SetBytes(token.signature[:32])
+		s := new(big.Int).SetBytes(token.signature[32:])
+		if r.BitLen() <= 248 || s.BitLen() <= 248 {
+			short++
+		}
+		err = token.verify(&key.PublicKey)
+		if err != nil {
+			t.Fatalf("signature %d: %v", i, err)
+		}
+	}
+	if short == 0 {
+		t.Fatalf("never got a short r or s")
+	}
+}
+
+func TestParseAppleKey(t *testing.T) {
+	key := newAppleKey(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	parsed, err := ParseAppleKey(p8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(key) {
+		t.Fatalf("parsed a different key")
+	}
+
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa_der, err := x509.MarshalPKCS8PrivateKey(rsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"not pem": der,
+		"rsa key": pem.EncodeToMemory(
+			&pem.Block{Type: "PRIVATE KEY", Bytes: rsa_der}),
+		"garbage": pem.EncodeToMemory(
+			&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}),
+	} {
+		if _, err := ParseAppleKey(data); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestAppleClientSecret(t *testing.T) {
+	key := newAppleKey(t)
+	provider := Apple(Config{ClientID: "com.example.web"}, "TEAM", "KEY",
+		key)
+	ctx := context.Background()
+
+	first, err := provider.ClientSecretSource(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := parseJWT(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header.Alg != "ES256" || token.Header.Kid != "KEY" {
+		t.Fatalf("got header %+v", token.Header)
+	}
+	if err := token.verify(&key.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseClaims(token.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "TEAM" || claims.Subject != "com.example.web" ||
+		!claims.hasAudience(appleURL) ||
+		claims.Expiry.Sub(claims.IssuedAt) != appleSecretLifetime {
+		t.Fatalf("got claims %+v", claims)
+	}
+
+	again, err := provider.ClientSecretSource(ctx)
+	if err != nil || again != first {
+		t.Fatalf("secret wasn't reused: %v", err)
+	}
+}
+
+func TestAppleClientSecretRenewal(t *testing.T) {
+	secret := &appleSecret{
+		team_id:   "TEAM",
+		key_id:    "KEY",
+		client_id: "com.example.web",
+		key:       newAppleKey(t)}
+	ctx := context.Background()
+	first, err := secret.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// secrets are renewed ahead of their expiry.
+	secret.expires = time.Now().Add(appleSecretRenewal / 2)
+	renewed, err := secret.get(ctx)
+	if err != nil || renewed == first {
+		t.Fatalf("secret wasn't renewed: %v", err)
+	}
+	if time.Until(secret.expires) <= appleSecretRenewal {
+		t.Fatalf("renewed secret expires at %v", secret.expires)
+	}
+}
+
+func TestAppleUserInfo(t *testing.T) {
+	callback := func(user string) *http.Request {
+		form := url.Values{"code": {"code"}, "state": {"state"}}
+		if user != "" {
+			form.Set("user", user)
+		}
+		r, err := http.NewRequest("POST", "/_cb",
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	claims := &Claims{Subject: "001234.abcd",
+		Email: "relay@privaterelay.appleid.com"}
+
+	for _, test := range []struct {
+		name   string
+		user   string
+		claims *Claims
+		info   UserInfo
+		ok     bool
+	}{
+		{"later login", "", claims, UserInfo{ID: "001234.abcd",
+			Email: "relay@privaterelay.appleid.com"}, true},
+		{"first login", `{"name": {"firstName": "Alice", ` +
+			`"lastName": "Smith"}, "email": "alice@example.com"}`, claims,
+			UserInfo{ID: "001234.abcd", Name: "Alice Smith",
+				Email: "relay@privaterelay.appleid.com"}, true},
+		{"email from user", `{"name": {"firstName": "Alice"}, ` +
+			`"email": "alice@example.com"}`, &Claims{Subject: "001234.abcd"},
+			UserInfo{ID: "001234.abcd", Name: "Alice",
+				Email: "alice@example.com"}, true},
+		{"malformed user", `{"name": `, claims, UserInfo{}, false},
+		{"no id token", "", nil, UserInfo{}, false},
+	} {
+		info, err := AppleUserInfo(callback(test.user), test.claims)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: got %+v", test.name, info)
+			}
+			continue
+		}
+		if err != nil || *info != test.info {
+			t.Errorf("%s: got %+v, %v", test.name, info, err)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/webhelp.v1/whcompat"
+	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whroute"
+)
+
+var (
+	// InvalidBearer is the error class for bearer tokens that fail
+	// validation.
+	InvalidBearer = wherr.Unauthorized.NewClass("invalid bearer token")
+)
+
+const (
+	// bearerCacheTTL is the longest a validation result is trusted.
+	bearerCacheTTL = 5 * time.Minute
+
+	// bearerCacheSize bounds the number of cached validation results.
+	bearerCacheSize = 10000
+)
+
+// BearerValidator checks a bearer token an API client presented and returns
+// the identity it belongs to. Tokens that aren't valid should produce an
+// InvalidBearer error.
+type BearerValidator func(ctx context.Context, provider *Provider,
+	bearer string) (*Identity, error)
+
+// IntrospectionValidator returns a BearerValidator that asks the provider's
+// RFC 7662 introspection endpoint about the token, authenticating with the
+// provider's client credentials. Only tokens that were issued to the
+// provider's client ID, or that name it as an audience, are accepted.
+func IntrospectionValidator(introspection_url string) BearerValidator {
+	return func(ctx context.Context, provider *Provider, bearer string) (
+		*Identity, error) {
+		vals := url.Values{
+			"token":           {bearer},
+			"token_type_hint": {"access_token"}}
+		inParams := provider.Endpoint.AuthStyle == oauth2.AuthStyleInParams
+		if inParams {
+			vals.Set("client_id", provider.ClientID)
+			vals.Set("client_secret", provider.ClientSecret)
+		}
+		req, err := http.NewRequest("POST", introspection_url,
+			strings.NewReader(vals.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		if !inParams {
+			req.SetBasicAuth(url.QueryEscape(provider.ClientID),
+				url.QueryEscape(provider.ClientSecret))
+		}
+		resp, err := contextClient(ctx).Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status from %s: %s",
+				introspection_url, resp.Status)
+		}
+		var result struct {
+			Active   bool            `json:"active"`
+			Scope    string          `json:"scope"`
+			ClientID string          `json:"client_id"`
+			Audience json.RawMessage `json:"aud"`
+			Subject  string          `json:"sub"`
+			Username string          `json:"username"`
+			Expiry   float64         `json:"exp"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		if err != nil {
+			return nil, err
+		}
+		if !result.Active {
+			return nil, InvalidBearer.New("token not active")
+		}
+		audience, err := parseAudience(result.Audience)
+		if err != nil {
+			return nil, err
+		}
+		if result.ClientID != provider.ClientID &&
+			!contains(audience, provider.ClientID) {
+			return nil, InvalidBearer.New("token not issued for %#v",
+				provider.ClientID)
+		}
+		subject := result.Subject
+		if subject == "" {
+			subject = result.Username
+		}
+		return &Identity{
+			Provider: provider.Name,
+			Subject:  subject,
+			Token: &oauth2.Token{
+				AccessToken: bearer,
+				TokenType:   "Bearer",
+				Expiry:      unixTime(result.Expiry)},
+			Scopes: strings.Fields(result.Scope)}, nil
+	}
+}
+
+// UserInfoValidator returns a BearerValidator that accepts any token the
+// provider's FetchUserInfo succeeds with.
+//
+// It can't tell which client a token was issued to, so any other application
+// that users log in to with the same provider can call the API as them with
+// its own tokens. Only use it when the provider offers nothing better, or
+// for tokens that can only come from this application.
+func UserInfoValidator() BearerValidator {
+	return func(ctx context.Context, provider *Provider, bearer string) (
+		*Identity, error) {
+		if provider.FetchUserInfo == nil {
+			return nil, fmt.Errorf("provider %#v can't fetch user info",
+				provider.Name)
+		}
+		token := &oauth2.Token{AccessToken: bearer, TokenType: "Bearer"}
+		info, err := provider.FetchUserInfo(ctx,
+			oauth2.NewClient(ctx, oauth2.StaticTokenSource(token)))
+		if err != nil {
+			return nil, InvalidBearer.Wrap(err)
+		}
+		return &Identity{
+			Provider: provider.Name,
+			Subject:  info.ID,
+			Token:    token,
+			UserInfo: info}, nil
+	}
+}
+
+// JWTValidator returns a BearerValidator for access tokens that are JWTs
+// signed by the provider's OIDC issuer. audience is the expected "aud" claim,
+// the provider's client ID if empty. ID tokens are signed by the same issuer,
+// so they are told apart by their claims, and unless audience is a resource
+// other than the client ID, tokens have to be RFC 9068 access tokens, with
+// the "at+jwt" type.
+func JWTValidator(audience string) BearerValidator {
+	return func(ctx context.Context, provider *Provider, bearer string) (
+		*Identity, error) {
+		if provider.OIDC == nil {
+			return nil, fmt.Errorf("provider %#v is not in OIDC mode",
+				provider.Name)
+		}
+		t, claims, err := provider.OIDC.verify(ctx, bearer)
+		if err != nil {
+			return nil, InvalidBearer.Wrap(err)
+		}
+		if _, has_at_hash := claims.Raw["at_hash"]; has_at_hash ||
+			claims.Nonce != "" {
+			return nil, InvalidBearer.New("id token used as access token")
+		}
+		aud := audience
+		if aud == "" {
+			aud = provider.ClientID
+		}
+		if aud == provider.ClientID && !isAccessTokenType(t.Header.Typ) {
+			return nil, InvalidBearer.New("not an access token")
+		}
+		if !claims.hasAudience(aud) {
+			return nil, InvalidBearer.New("token not issued for %#v", aud)
+		}
+		scope, _ := claims.Raw["scope"].(string)
+		return &Identity{
+			Provider: provider.Name,
+			Subject:  claims.Subject,
+			Token: &oauth2.Token{
+				AccessToken: bearer,
+				TokenType:   "Bearer",
+				Expiry:      claims.Expiry},
+			Scopes: strings.Fields(scope),
+			Claims: claims}, nil
+	}
+}
+
+// isAccessTokenType returns whether typ is the JWT type RFC 9068 gives
+// access tokens.
+func isAccessTokenType(typ string) bool {
+	typ = strings.ToLower(typ)
+	return typ == "at+jwt" || typ == "application/at+jwt"
+}
+
+// bearerCache remembers validation results so that every API request doesn't
+// cost a round trip to the provider. Tokens are keyed by their hash.
+type bearerCache struct {
+	mtx     sync.Mutex
+	entries map[[sha256.Size]byte]bearerCacheEntry
+}
+
+type bearerCacheEntry struct {
+	id      *Identity
+	expires time.Time
+}
+
+func (c *bearerCache) get(bearer string) (*Identity, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry, found := c.entries[sha256.Sum256([]byte(bearer))]
+	if !found || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.id, true
+}
+
+func (c *bearerCache) put(bearer string, id *Identity) {
+	expires := time.Now().Add(bearerCacheTTL)
+	if id.Token != nil && !id.Token.Expiry.IsZero() &&
+		id.Token.Expiry.Before(expires) {
+		expires = id.Token.Expiry
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[[sha256.Size]byte]bearerCacheEntry)
+	}
+	if len(c.entries) >= bearerCacheSize {
+		now := time.Now()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		// still full, so make room by dropping arbitrary entries.
+		for key := range c.entries {
+			if len(c.entries) < bearerCacheSize {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	c.entries[sha256.Sum256([]byte(bearer))] = bearerCacheEntry{
+		id: id, expires: expires}
+}
+
+// bearerToken returns the token from the request's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[7:])
+	return token, token != ""
+}
+
+// BearerRequired is a middleware for API endpoints used by non-browser
+// clients. Requests with an "Authorization: Bearer" header are authenticated
+// by checking the token with validator, and Identity, Token, Claims and
+// UserInfo then return the token's identity for the rest of the request.
+// Everything else, including requests from users logged in through the
+// session, gets a 401 JSON response. Validation results are cached for a few
+// minutes.
+func (o *ProviderHandler) BearerRequired(h http.Handler,
+	validator BearerValidator) http.Handler {
+	return o.bearerRequired(h, validator, false)
+}
+
+// BearerOrLoginRequired is like BearerRequired, except that requests without
+// an "Authorization: Bearer" header are let through if the user is logged in
+// through the session as usual, so the same endpoints serve the application's
+// own pages. Browsers send session cookies along with requests that other
+// sites make, so endpoints behind BearerOrLoginRequired that change anything
+// need their own CSRF protection.
+func (o *ProviderHandler) BearerOrLoginRequired(h http.Handler,
+	validator BearerValidator) http.Handler {
+	return o.bearerRequired(h, validator, true)
+}
+
+// bearerRequired implements BearerRequired, and BearerOrLoginRequired if
+// session is true.
+func (o *ProviderHandler) bearerRequired(h http.Handler,
+	validator BearerValidator, session bool) http.Handler {
+	cache := &bearerCache{}
+	return whroute.HandlerFunc(h,
+		func(w http.ResponseWriter, r *http.Request) {
+			r = withResponseWriter(r, w)
+			ctx := whcompat.Context(r)
+			bearer, found := bearerToken(r)
+			if !found {
+				if !session {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					writeJSONError(w, InvalidBearer.New("no bearer token"))
+					return
+				}
+				token, err := o.Token(ctx)
+				if err != nil {
+					writeJSONError(w, err)
+					return
+				}
+				if token == nil {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					writeJSONError(w, InvalidBearer.New("no bearer token"))
+					return
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			id, cached := cache.get(bearer)
+			if !cached {
+				provider, err := o.provider.withSecret(ctx)
+				if err == nil {
+					id, err = validator(ctx, provider, bearer)
+				}
+				if err != nil {
+					if InvalidBearer.Contains(err) {
+						w.Header().Set("WWW-Authenticate",
+							`Bearer error="invalid_token"`)
+					}
+					writeJSONError(w, err)
+					return
+				}
+				cache.put(bearer, id)
+			}
+			h.ServeHTTP(w, whcompat.WithContext(r,
+				context.WithValue(ctx, bearerKey{handler: o}, id)))
+		})
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestBearerCacheTTL(t *testing.T) {
+	var cache bearerCache
+	long := &Identity{Subject: "long", Token: &oauth2.Token{
+		Expiry: time.Now().Add(time.Hour)}}
+	short := &Identity{Subject: "short", Token: &oauth2.Token{
+		Expiry: time.Now().Add(time.Minute)}}
+	cache.put("long", long)
+	cache.put("short", short)
+	cache.put("no expiry", &Identity{Subject: "no expiry"})
+
+	for _, test := range []struct {
+		bearer string
+		ttl    time.Duration
+	}{
+		// results are trusted for bearerCacheTTL at most, and never past
+		// the token's expiry.
+		{"long", bearerCacheTTL},
+		{"short", time.Minute},
+		{"no expiry", bearerCacheTTL},
+	} {
+		id, found := cache.get(test.bearer)
+		if !found || id.Subject != test.bearer {
+			t.Fatalf("%s: got %+v, %v", test.bearer, id, found)
+		}
+		entry := cache.entries[sha256.Sum256([]byte(test.bearer))]
+		ttl := time.Until(entry.expires)
+		if ttl > test.ttl || ttl < test.ttl-time.Second {
+			t.Errorf("%s: cached for %v", test.bearer, ttl)
+		}
+	}
+
+	if _, found := cache.get("missing"); found {
+		t.Fatalf("found a token that was never cached")
+	}
+	key := sha256.Sum256([]byte("short"))
+	entry := cache.entries[key]
+	entry.expires = time.Now().Add(-time.Second)
+	cache.entries[key] = entry
+	if _, found := cache.get("short"); found {
+		t.Fatalf("found an expired entry")
+	}
+}
+
+func TestBearerCacheEviction(t *testing.T) {
+	var cache bearerCache
+	for i := 0; i < bearerCacheSize; i++ {
+		cache.put(fmt.Sprint(i), &Identity{})
+	}
+	// expired entries make room first.
+	for i := 0; i < 10; i++ {
+		key := sha256.Sum256([]byte(fmt.Sprint(i)))
+		entry := cache.entries[key]
+		entry.expires = time.Now().Add(-time.Second)
+		cache.entries[key] = entry
+	}
+	cache.put("new", &Identity{})
+	if len(cache.entries) != bearerCacheSize-9 {
+		t.Fatalf("got %d entries", len(cache.entries))
+	}
+	for i := 10; i < bearerCacheSize; i++ {
+		if _, found := cache.get(fmt.Sprint(i)); !found {
+			t.Fatalf("entry %d was evicted", i)
+		}
+	}
+
+	// a cache full of live entries drops one to make room.
+	for i := 0; len(cache.entries) < bearerCacheSize; i++ {
+		cache.put(fmt.Sprint("more", i), &Identity{})
+	}
+	cache.put("newest", &Identity{})
+	if len(cache.entries) != bearerCacheSize {
+		t.Fatalf("got %d entries", len(cache.entries))
+	}
+	if _, found := cache.get("newest"); !found {
+		t.Fatalf("newest entry is missing")
+	}
+}
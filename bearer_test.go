@@ -0,0 +1,343 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+)
+
+func TestJWTValidator(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	provider := idp.Provider("test", "")
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   idp.URL,
+			"sub":   "alice",
+			"aud":   whoauth2test.ClientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": "read write"}
+		for name, val := range changes {
+			c[name] = val
+		}
+		return c
+	}
+	api := map[string]interface{}{"aud": "https://api.example.com"}
+
+	for _, test := range []struct {
+		name     string
+		audience string
+		token    string
+		ok       bool
+	}{
+		{"access token", "",
+			idp.SignAccessToken(claims(nil)), true},
+		{"id token", "",
+			idp.Sign(claims(map[string]interface{}{"nonce": "n"})), false},
+		{"id token with at_hash", "",
+			idp.Sign(claims(map[string]interface{}{"at_hash": "h"})), false},
+		{"untyped token for the client", "",
+			idp.Sign(claims(nil)), false},
+		{"access token with a nonce", "",
+			idp.SignAccessToken(claims(map[string]interface{}{
+				"nonce": "n"})), false},
+		{"expired access token", "",
+			idp.SignAccessToken(claims(map[string]interface{}{
+				"exp": time.Now().Add(-time.Hour).Unix()})), false},
+		{"resource token", "https://api.example.com",
+			idp.Sign(claims(api)), true},
+		{"resource access token", "https://api.example.com",
+			idp.SignAccessToken(claims(api)), true},
+		{"id token for a resource", "https://api.example.com",
+			idp.Sign(claims(nil)), false},
+		{"untyped token with client audience", whoauth2test.ClientID,
+			idp.Sign(claims(nil)), false},
+	} {
+		id, err := whoauth2.JWTValidator(test.audience)(
+			context.Background(), provider, test.token)
+		if !test.ok {
+			if !whoauth2.InvalidBearer.Contains(err) {
+				t.Errorf("%s: expected InvalidBearer, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if id.Subject != "alice" || len(id.Scopes) != 2 {
+			t.Errorf("%s: got identity %+v", test.name, id)
+		}
+	}
+}
+
+func TestIntrospectionValidator(t *testing.T) {
+	var response map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(response)
+		}))
+	defer server.Close()
+	provider := whoauth2test.ServerProvider("test", server.URL, "")
+	validator := whoauth2.IntrospectionValidator(server.URL)
+
+	for _, test := range []struct {
+		name     string
+		response map[string]interface{}
+		ok       bool
+	}{
+		{"issued to the client", map[string]interface{}{
+			"active": true, "sub": "alice",
+			"client_id": whoauth2test.ClientID}, true},
+		{"client is the audience", map[string]interface{}{
+			"active": true, "sub": "alice", "client_id": "other",
+			"aud": []string{"other", whoauth2test.ClientID}}, true},
+		{"issued to another client", map[string]interface{}{
+			"active": true, "sub": "alice", "client_id": "other",
+			"aud": "other"}, false},
+		{"no client", map[string]interface{}{
+			"active": true, "sub": "alice"}, false},
+		{"inactive", map[string]interface{}{"active": false}, false},
+	} {
+		response = test.response
+		id, err := validator(context.Background(), provider, "token")
+		if !test.ok {
+			if !whoauth2.InvalidBearer.Contains(err) {
+				t.Errorf("%s: expected InvalidBearer, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil || id.Subject != "alice" {
+			t.Errorf("%s: got %+v, %v", test.name, id, err)
+		}
+	}
+}
+
+func TestIntrospectionValidatorServer(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	provider := idp.Provider("test", "")
+	ctx := context.Background()
+
+	token, err := provider.DeviceLogin(ctx,
+		func(da *whoauth2.DeviceAuth) error {
+			return idp.ApproveDevice(da.UserCode)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := whoauth2.IntrospectionValidator(provider.IntrospectionURL)
+	id, err := validator(ctx, provider, token.AccessToken)
+	if err != nil || id.Subject != "alice" {
+		t.Fatalf("got %+v, %v", id, err)
+	}
+	idp.ExpireTokens()
+	_, err = validator(ctx, provider, token.AccessToken)
+	if !whoauth2.InvalidBearer.Contains(err) {
+		t.Fatalf("expired token: got %v", err)
+	}
+}
+
+func TestUserInfoValidator(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	provider := idp.Provider("test", "")
+	ctx := context.Background()
+
+	token, err := provider.DeviceLogin(ctx,
+		func(da *whoauth2.DeviceAuth) error {
+			return idp.ApproveDevice(da.UserCode)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := whoauth2.UserInfoValidator()
+	id, err := validator(ctx, provider, token.AccessToken)
+	if err != nil || id.Subject != "alice" || id.UserInfo == nil ||
+		id.UserInfo.ID != "alice" {
+		t.Fatalf("got %+v, %v", id, err)
+	}
+	_, err = validator(ctx, provider, "bogus")
+	if !whoauth2.InvalidBearer.Contains(err) {
+		t.Fatalf("bogus token: got %v", err)
+	}
+
+	// without FetchUserInfo, nothing can be validated, which is a
+	// configuration problem rather than a bad token.
+	provider.FetchUserInfo = nil
+	_, err = validator(ctx, provider, token.AccessToken)
+	if err == nil || whoauth2.InvalidBearer.Contains(err) {
+		t.Fatalf("no FetchUserInfo: got %v", err)
+	}
+}
+
+// getAPI fetches url as user with the given Authorization header, if any.
+func getAPI(user *whoauth2test.User, url, auth string) (*http.Response,
+	string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := user.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, string(body), err
+}
+
+func TestBearerRequired(t *testing.T) {
+	idp := whoauth2test.NewServer(
+		whoauth2test.Identity{Subject: "alice"},
+		whoauth2test.Identity{Subject: "bob"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+
+	var mtx sync.Mutex
+	validations := 0
+	validator := whoauth2.UserInfoValidator()
+	app.mux.Handle("/api", app.handler.BearerRequired(
+		http.HandlerFunc(app.page),
+		func(ctx context.Context, provider *whoauth2.Provider,
+			bearer string) (*whoauth2.Identity, error) {
+			mtx.Lock()
+			validations++
+			mtx.Unlock()
+			return validator(ctx, provider, bearer)
+		}))
+
+	token, err := idp.Provider("cli", "").DeviceLogin(context.Background(),
+		func(da *whoauth2.DeviceAuth) error {
+			return idp.ApproveDevice(da.UserCode)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := idp.User("bob")
+	for _, test := range []struct {
+		name         string
+		auth         string
+		status       int
+		authenticate string
+		body         string
+		validations  int
+	}{
+		{"no token", "", http.StatusUnauthorized, "Bearer", "", 0},
+		{"bad token", "Bearer bogus", http.StatusUnauthorized,
+			`Bearer error="invalid_token"`, "", 1},
+		{"bad tokens aren't cached", "Bearer bogus",
+			http.StatusUnauthorized, `Bearer error="invalid_token"`, "", 2},
+		{"not a bearer token", "Basic Ym9iOnB3", http.StatusUnauthorized,
+			"Bearer", "", 2},
+		{"token", "Bearer " + token.AccessToken, http.StatusOK, "",
+			"logged in as alice", 3},
+		{"cached token", "bearer " + token.AccessToken, http.StatusOK, "",
+			"logged in as alice", 3},
+	} {
+		resp, body, err := getAPI(user, app.URL+"/api", test.auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status ||
+			resp.Header.Get("WWW-Authenticate") != test.authenticate {
+			t.Errorf("%s: got %s with %#v: %s", test.name, resp.Status,
+				resp.Header.Get("WWW-Authenticate"), body)
+		}
+		if test.body != "" && body != test.body {
+			t.Errorf("%s: got %#v", test.name, body)
+		}
+		if test.status == http.StatusUnauthorized &&
+			resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: got content type %#v", test.name,
+				resp.Header.Get("Content-Type"))
+		}
+		mtx.Lock()
+		if validations != test.validations {
+			t.Errorf("%s: got %d validations", test.name, validations)
+		}
+		mtx.Unlock()
+	}
+
+	// the session isn't enough, since other sites can make browsers send
+	// it along.
+	resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, _, err = getAPI(user, app.URL+"/api", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized ||
+		resp.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("session without a bearer token: got %s", resp.Status)
+	}
+}
+
+func TestBearerOrLoginRequired(t *testing.T) {
+	idp := whoauth2test.NewServer(
+		whoauth2test.Identity{Subject: "alice"},
+		whoauth2test.Identity{Subject: "bob"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	app.mux.Handle("/api", app.handler.BearerOrLoginRequired(
+		http.HandlerFunc(app.page), whoauth2.UserInfoValidator()))
+
+	token, err := idp.Provider("cli", "").DeviceLogin(context.Background(),
+		func(da *whoauth2.DeviceAuth) error {
+			return idp.ApproveDevice(da.UserCode)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := idp.User("bob")
+	resp, _, err := getAPI(user, app.URL+"/api", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized ||
+		resp.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("logged out: got %s", resp.Status)
+	}
+
+	// requests without a bearer token go by the session, and bearer tokens
+	// win over it.
+	resp, err = user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for auth, want := range map[string]string{
+		"":                            "logged in as bob",
+		"Bearer " + token.AccessToken: "logged in as alice",
+	} {
+		resp, body, err := getAPI(user, app.URL+"/api", auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("auth %#v: got %s %#v", auth, resp.Status, body)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whredir"
+)
+
+// Error codes a provider may send to the callback, from RFC 6749 section
+// 4.1.2.1.
+const (
+	ErrorInvalidRequest          = "invalid_request"
+	ErrorUnauthorizedClient      = "unauthorized_client"
+	ErrorAccessDenied            = "access_denied"
+	ErrorUnsupportedResponseType = "unsupported_response_type"
+	ErrorInvalidScope            = "invalid_scope"
+	ErrorServerError             = "server_error"
+	ErrorTemporarilyUnavailable  = "temporarily_unavailable"
+)
+
+// AuthorizationError is an error response the provider sent to the callback
+// instead of an authorization code, for instance because the user clicked
+// "Deny".
+type AuthorizationError struct {
+	// Code is one of the Error constants, or a provider specific code.
+	Code        string
+	Description string
+	URI         string
+}
+
+func (e *AuthorizationError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("authorization failed: %s: %s", e.Code,
+			e.Description)
+	}
+	return fmt.Sprintf("authorization failed: %s", e.Code)
+}
+
+// httpError wraps e in a wherr class with a fitting status code.
+func (e *AuthorizationError) httpError() error {
+	switch e.Code {
+	case ErrorAccessDenied:
+		return wherr.Forbidden.Wrap(e)
+	case ErrorServerError:
+		return wherr.BadGateway.Wrap(e)
+	case ErrorTemporarilyUnavailable:
+		return wherr.ServiceUnavailable.Wrap(e)
+	case ErrorInvalidRequest, ErrorUnauthorizedClient,
+		ErrorUnsupportedResponseType, ErrorInvalidScope:
+		// these are configuration problems on our end.
+		return wherr.InternalServerError.Wrap(e)
+	}
+	return wherr.BadRequest.Wrap(e)
+}
+
+// authorizationError returns the provider's error response in r, if any.
+func authorizationError(r *http.Request) *AuthorizationError {
+	code := r.FormValue("error")
+	if code == "" {
+		return nil
+	}
+	return &AuthorizationError{
+		Code:        code,
+		Description: r.FormValue("error_description"),
+		URI:         r.FormValue("error_uri")}
+}
+
+// loginErrorURL returns the LoginErrorURL with the reason for e attached.
+func (u *RedirectURLs) loginErrorURL(e *AuthorizationError) string {
+	vals := url.Values{"error": {e.Code}}
+	if e.Description != "" {
+		vals.Set("error_description", e.Description)
+	}
+	sep := "?"
+	if strings.Contains(u.LoginErrorURL, "?") {
+		sep = "&"
+	}
+	return u.LoginErrorURL + sep + vals.Encode()
+}
+
+// handleLoginError writes the default response for a failed login, as JSON
+// if the request asked for it.
+func (u *RedirectURLs) handleLoginError(w http.ResponseWriter,
+	r *http.Request, err error) {
+	if wantsJSON(r) {
+		writeJSONError(w, err)
+		return
+	}
+	if e, ok := err.(*AuthorizationError); ok {
+		if u.LoginErrorURL != "" {
+			whredir.Redirect(w, r, u.loginErrorURL(e))
+			return
+		}
+		err = e.httpError()
+	}
+	wherr.Handle(w, r, err)
+}
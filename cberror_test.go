@@ -0,0 +1,130 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spacemonkeygo/errors/errhttp"
+	"gopkg.in/webhelp.v1/wherr"
+)
+
+func TestAuthorizationErrorStatus(t *testing.T) {
+	for _, test := range []struct {
+		code   string
+		status int
+	}{
+		{ErrorAccessDenied, http.StatusForbidden},
+		{ErrorServerError, http.StatusBadGateway},
+		{ErrorTemporarilyUnavailable, http.StatusServiceUnavailable},
+		{ErrorInvalidRequest, http.StatusInternalServerError},
+		{ErrorUnauthorizedClient, http.StatusInternalServerError},
+		{ErrorUnsupportedResponseType, http.StatusInternalServerError},
+		{ErrorInvalidScope, http.StatusInternalServerError},
+		{"consent_required", http.StatusBadRequest},
+	} {
+		e := &AuthorizationError{Code: test.code}
+		status := errhttp.GetStatusCode(e.httpError(), 0)
+		if status != test.status {
+			t.Errorf("%s: got %d, want %d", test.code, status, test.status)
+		}
+	}
+}
+
+func TestAuthorizationErrorMessage(t *testing.T) {
+	for _, test := range []struct {
+		err  *AuthorizationError
+		want string
+	}{
+		{&AuthorizationError{Code: ErrorAccessDenied},
+			"authorization failed: access_denied"},
+		{&AuthorizationError{Code: ErrorAccessDenied,
+			Description: "user said no", URI: "https://example.com/"},
+			"authorization failed: access_denied: user said no"},
+	} {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("got %#v, want %#v", got, test.want)
+		}
+	}
+}
+
+func TestLoginErrorURL(t *testing.T) {
+	for _, test := range []struct {
+		login_error_url string
+		err             *AuthorizationError
+		want            string
+	}{
+		{"/error", &AuthorizationError{Code: ErrorAccessDenied},
+			"/error?error=access_denied"},
+		{"/error?from=login", &AuthorizationError{Code: ErrorAccessDenied},
+			"/error?from=login&error=access_denied"},
+		{"/error", &AuthorizationError{Code: ErrorServerError,
+			Description: "down & out", URI: "https://example.com/"},
+			"/error?error=server_error&error_description=down+%26+out"},
+	} {
+		urls := &RedirectURLs{LoginErrorURL: test.login_error_url}
+		if got := urls.loginErrorURL(test.err); got != test.want {
+			t.Errorf("got %#v, want %#v", got, test.want)
+		}
+	}
+}
+
+func TestHandleLoginError(t *testing.T) {
+	denied := &AuthorizationError{Code: ErrorAccessDenied,
+		Description: "user said no"}
+	for _, test := range []struct {
+		name            string
+		login_error_url string
+		json            bool
+		err             error
+		status          int
+		location        string
+		error_code      string
+	}{
+		{"denied", "", false, denied, http.StatusForbidden, "", ""},
+		{"denied redirect", "/error", false, denied, http.StatusSeeOther,
+			"/error?error=access_denied&error_description=user+said+no", ""},
+		{"denied json", "/error", true, denied, http.StatusForbidden, "",
+			ErrorAccessDenied},
+		// only errors from the provider go to LoginErrorURL.
+		{"bad request", "/error", false, wherr.BadRequest.New("missing code"),
+			http.StatusBadRequest, "", ""},
+		{"bad request json", "", true, wherr.BadRequest.New("missing code"),
+			http.StatusBadRequest, "", ErrorInvalidRequest},
+		{"other", "/error", false, errors.New("oops"),
+			http.StatusInternalServerError, "", ""},
+		{"other json", "", true, errors.New("oops"),
+			http.StatusInternalServerError, "", ErrorServerError},
+	} {
+		urls := &RedirectURLs{LoginErrorURL: test.login_error_url}
+		r, err := http.NewRequest("GET", "/_cb", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.json {
+			r.Header.Set("Accept", "application/json")
+		}
+		w := httptest.NewRecorder()
+		urls.handleLoginError(w, r, test.err)
+
+		if w.Code != test.status ||
+			w.Header().Get("Location") != test.location {
+			t.Errorf("%s: got %d to %#v", test.name, w.Code,
+				w.Header().Get("Location"))
+			continue
+		}
+		if test.error_code == "" {
+			continue
+		}
+		var body map[string]string
+		err = json.NewDecoder(w.Body).Decode(&body)
+		if err != nil || body["error"] != test.error_code {
+			t.Errorf("%s: got %v, %v", test.name, body, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/webhelp.v1/wherr"
+)
+
+var (
+	// NotLoggedIn is the error class returned when an operation needs a
+	// logged in user and there isn't one.
+	NotLoggedIn = wherr.Unauthorized.NewClass("not logged in")
+)
+
+// sessionTokenSource is an oauth2.TokenSource that reads the token out of
+// the session, saving it back whenever it has to be refreshed.
+type sessionTokenSource struct {
+	ctx     context.Context
+	handler *ProviderHandler
+}
+
+func (s *sessionTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.handler.Token(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, NotLoggedIn.New("%s", s.handler.provider.Name)
+	}
+	return token, nil
+}
+
+// TokenSource returns an oauth2.TokenSource for the logged in user. Tokens
+// it refreshes are saved to the session using w, so it should be used before
+// the response headers are written.
+func (o *ProviderHandler) TokenSource(ctx context.Context,
+	w http.ResponseWriter) (oauth2.TokenSource, error) {
+	ctx = context.WithValue(ctx, responseWriterKey(0), w)
+	src := &sessionTokenSource{ctx: ctx, handler: o}
+	token, err := src.Token()
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.ReuseTokenSource(token, src), nil
+}
+
+// Client returns an *http.Client that authenticates requests with the logged
+// in user's token. Tokens it refreshes are saved to the session using w, so
+// it should be used before the response headers are written.
+func (o *ProviderHandler) Client(ctx context.Context,
+	w http.ResponseWriter) (*http.Client, error) {
+	src, err := o.TokenSource(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(ctx, src), nil
+}
+
+// Client returns an *http.Client that authenticates requests with the logged
+// in user's token for the named provider. See (*ProviderHandler).Client.
+func (g *ProviderGroup) Client(ctx context.Context, w http.ResponseWriter,
+	provider_name string) (*http.Client, error) {
+	handler, exists := g.handlers[provider_name]
+	if !exists {
+		return nil, wherr.NotFound.New("unknown provider %#v", provider_name)
+	}
+	return handler.Client(ctx, w)
+}
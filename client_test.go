@@ -0,0 +1,68 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+	"gopkg.in/webhelp.v1/whcompat"
+)
+
+func TestClient(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	user := idp.User("")
+	app := newRefreshingApp(t, idp, user)
+	defer app.Close()
+	// the client saves refreshed tokens itself, without SaveRefreshedTokens.
+	app.mux.HandleFunc("/profile",
+		func(w http.ResponseWriter, r *http.Request) {
+			client, err := app.handler.Client(whcompat.Context(r), w)
+			if whoauth2.NotLoggedIn.Contains(err) {
+				http.Error(w, "logged out", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp, err := client.Get(idp.URL + "/userinfo")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer resp.Body.Close()
+			var claims struct {
+				Subject string `json:"sub"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&claims)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(claims.Subject))
+		})
+
+	// refresh tokens are rotated, so each request only works if the client
+	// saved the token it refreshed during the one before.
+	for i := 0; i < 3; i++ {
+		refreshes := idp.Refreshes()
+		body, status, err := app.get(user, "/profile")
+		if err != nil || status != http.StatusOK || body != "alice" {
+			t.Fatalf("request %d: got %d %#v, %v", i, status, body, err)
+		}
+		if idp.Refreshes() == refreshes {
+			t.Fatalf("request %d: token wasn't refreshed", i)
+		}
+	}
+
+	body, status, err := app.get(idp.User(""), "/profile")
+	if err != nil || status != http.StatusUnauthorized {
+		t.Fatalf("logged out: got %d %#v, %v", status, body, err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+// Command whoauth2-devidp runs an OpenID Connect identity provider for local
+// development. Point an application at it with whoauth2dev.Provider and log
+// in by picking one of the configured users.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2dev"
+)
+
+var (
+	listenAddr = flag.String("addr", "127.0.0.1:9000",
+		"address to listen on")
+	identitiesFile = flag.String("identities", "",
+		"JSON file with a list of users, each with Subject, Email, Name, "+
+			"Picture and Claims fields")
+)
+
+func main() {
+	flag.Parse()
+
+	var identities []whoauth2dev.Identity
+	if *identitiesFile != "" {
+		data, err := ioutil.ReadFile(*identitiesFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = json.Unmarshal(data, &identities)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *identitiesFile, err)
+			os.Exit(1)
+		}
+	}
+
+	s, err := whoauth2dev.NewServer(*listenAddr, identities...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("development identity provider at %s\n", s.URL)
+	fmt.Printf("use whoauth2dev.Provider(conf, %q)\n", s.URL)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	<-sigs
+	err = s.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"net/http"
+	"sort"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/webhelp.v1/whcompat"
+	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whredir"
+	"gopkg.in/webhelp.v1/whroute"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+// identityHook is called by a handler's callback with the identity of a
+// successful login, before OnLoginSuccess. It fails if the login conflicts
+// with the user's other logins, and otherwise returns a function that records
+// it, which the callback calls once the application accepted the login.
+// attach is set for logins started through an AttachURL.
+type identityHook func(ctx context.Context, id *Identity, attach bool) (
+	commit func(w http.ResponseWriter) error, err error)
+
+// Session returns the group-wide session, which is kept apart from each
+// provider's session and cleared by LogoutAll.
+func (g *ProviderGroup) Session(ctx context.Context) (*whsess.Session,
+	error) {
+	return whsess.Load(ctx, g.session_namespace)
+}
+
+// onIdentity is called by the providers' callbacks once a login succeeded. It
+// checks that the identity can be linked to the user's account, and returns a
+// function that links it and remembers the provider as the most recent login.
+func (g *ProviderGroup) onIdentity(ctx context.Context, id *Identity,
+	attach bool) (func(w http.ResponseWriter) error, error) {
+	session, err := g.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var link func() error
+	if g.identities != nil {
+		link, err = g.linkIdentity(ctx, session, id, attach)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(w http.ResponseWriter) error {
+		if link != nil {
+			err := link()
+			if err != nil {
+				return err
+			}
+		}
+		session.Values["_current"] = id.Provider
+		return session.Save(ctx, w)
+	}, nil
+}
+
+// SetPrimary makes provider_name the user's primary provider, which
+// CurrentIdentity prefers over the most recent login for as long as the user
+// stays logged in with it.
+func (g *ProviderGroup) SetPrimary(ctx context.Context, w http.ResponseWriter,
+	provider_name string) error {
+	if _, exists := g.handlers[provider_name]; !exists {
+		return wherr.BadRequest.New("unknown provider %#v", provider_name)
+	}
+	session, err := g.Session(ctx)
+	if err != nil {
+		return err
+	}
+	session.Values["_primary"] = provider_name
+	return session.Save(ctx, w)
+}
+
+// CurrentIdentity returns the identity the user is authenticated as, or nil
+// if the user isn't logged in with any provider. That's the primary provider
+// (see SetPrimary) if the user is logged in with it, otherwise the provider
+// the user logged in with most recently. Requests authenticated by
+// BearerRequired get the bearer token's identity.
+func (g *ProviderGroup) CurrentIdentity(ctx context.Context) (*Identity,
+	error) {
+	for _, handler := range g.handlers {
+		if id, ok := handler.bearerIdentity(ctx); ok {
+			return id, nil
+		}
+	}
+	session, err := g.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	primary, _ := session.Values["_primary"].(string)
+	current, _ := session.Values["_current"].(string)
+	names := make([]string, 0, len(g.handlers))
+	for name := range g.handlers {
+		if name != primary && name != current {
+			names = append(names, name)
+		}
+	}
+	// fall back to other logins in a stable order, for users that logged in
+	// before the group kept track.
+	sort.Strings(names)
+	for _, name := range append([]string{primary, current}, names...) {
+		handler, exists := g.handlers[name]
+		if !exists {
+			continue
+		}
+		id, err := handler.Identity(ctx)
+		if err != nil || id != nil {
+			return id, err
+		}
+	}
+	return nil, nil
+}
+
+// LoginPolicy decides whether a user counts as logged in for
+// (*ProviderGroup).LoginRequiredPolicy, given the tokens of the providers
+// the user is logged in with.
+type LoginPolicy func(g *ProviderGroup,
+	tokens map[string]*oauth2.Token) bool
+
+// RequireAny is the LoginPolicy that is satisfied by a login with any
+// provider.
+func RequireAny() LoginPolicy {
+	return func(g *ProviderGroup, tokens map[string]*oauth2.Token) bool {
+		return len(tokens) > 0
+	}
+}
+
+// RequireAll is the LoginPolicy that requires a login with every provider in
+// the group.
+func RequireAll() LoginPolicy {
+	return func(g *ProviderGroup, tokens map[string]*oauth2.Token) bool {
+		return len(tokens) == len(g.handlers)
+	}
+}
+
+// RequireProviders is the LoginPolicy that requires a login with each of the
+// named providers.
+func RequireProviders(provider_names ...string) LoginPolicy {
+	return func(g *ProviderGroup, tokens map[string]*oauth2.Token) bool {
+		for _, name := range provider_names {
+			if tokens[name] == nil {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// LoginRequiredPolicy is like LoginRequired, but users have to satisfy policy
+// instead of being logged in with any provider.
+func (g *ProviderGroup) LoginRequiredPolicy(h http.Handler,
+	policy LoginPolicy,
+	login_redirect func(redirect_to string) (url string)) http.Handler {
+	return whroute.HandlerFunc(h,
+		func(w http.ResponseWriter, r *http.Request) {
+			r = withResponseWriter(r, w)
+			tokens, err := g.Tokens(whcompat.Context(r))
+			if err != nil {
+				wherr.Handle(w, r, err)
+				return
+			}
+			if !policy(g, tokens) {
+				login_url := login_redirect(r.RequestURI)
+				if wantsJSON(r) {
+					loginRequiredJSON(w, login_url)
+					return
+				}
+				whredir.Redirect(w, r, login_url)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/webhelp.v1/whcompat"
+)
+
+func TestCurrentIdentity(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+	// logins with different providers don't need to be linked here.
+	app.group.SetIdentityStore(nil)
+	app.mux.HandleFunc("/current",
+		func(w http.ResponseWriter, r *http.Request) {
+			id, err := app.group.CurrentIdentity(whcompat.Context(r))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if id == nil {
+				fmt.Fprint(w, "nobody")
+				return
+			}
+			fmt.Fprintf(w, "%s %s", id.Provider, id.Subject)
+		})
+	app.mux.HandleFunc("/primary",
+		func(w http.ResponseWriter, r *http.Request) {
+			err := app.group.SetPrimary(whcompat.Context(r), w,
+				r.FormValue("provider"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		})
+
+	user := app.user()
+	for _, step := range []struct {
+		name    string
+		login   string
+		subject string
+		primary string
+		logout  string
+		current string
+	}{
+		{name: "logged out", current: "nobody"},
+		{name: "first login", login: "a", subject: "alice",
+			current: "a alice"},
+		{name: "second login", login: "b", subject: "bob", current: "b bob"},
+		{name: "most recent login", login: "a", subject: "alice",
+			current: "a alice"},
+		{name: "primary", primary: "b", current: "b bob"},
+		{name: "primary beats recent login", login: "a", subject: "alice",
+			current: "b bob"},
+		{name: "logged out of primary", logout: "b", current: "a alice"},
+		{name: "primary logs in again", login: "b", subject: "bob",
+			current: "b bob"},
+		{name: "logged out of the other", logout: "a", current: "b bob"},
+	} {
+		if step.login != "" {
+			_, err := app.login(t, user, step.login, step.subject)
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+		if step.primary != "" {
+			body, _, err := fetch(user.Client,
+				app.URL+"/primary?provider="+step.primary)
+			if err != nil || body != "ok" {
+				t.Fatalf("%s: got %#v, %v", step.name, body, err)
+			}
+		}
+		if step.logout != "" {
+			_, _, err := fetch(user.Client,
+				app.URL+app.group.LogoutURL(step.logout, "/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		body, _, err := fetch(user.Client, app.URL+"/current")
+		if err != nil || body != step.current {
+			t.Fatalf("%s: got %#v, %v", step.name, body, err)
+		}
+	}
+
+	_, status, err := fetch(user.Client, app.URL+"/primary?provider=c")
+	if err != nil || status != http.StatusBadRequest {
+		t.Fatalf("unknown primary: got %d, %v", status, err)
+	}
+}
+
+func TestLoginRequiredPolicy(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+	app.group.SetIdentityStore(nil)
+	choose := func(redirect_to string) string { return "/choose" }
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	policies := map[string]whoauth2.LoginPolicy{
+		"/any":  whoauth2.RequireAny(),
+		"/all":  whoauth2.RequireAll(),
+		"/b":    whoauth2.RequireProviders("b"),
+		"/none": whoauth2.RequireProviders()}
+	for path, policy := range policies {
+		app.mux.Handle(path, app.group.LoginRequiredPolicy(ok, policy, choose))
+	}
+
+	user := app.user()
+	client := &http.Client{Jar: user.Jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	for _, step := range []struct {
+		login   string
+		allowed map[string]bool
+	}{
+		{"", map[string]bool{"/none": true}},
+		{"a", map[string]bool{"/none": true, "/any": true}},
+		{"b", map[string]bool{"/none": true, "/any": true, "/all": true,
+			"/b": true}},
+	} {
+		if step.login != "" {
+			if _, err := app.login(t, user, step.login, "alice"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for path := range policies {
+			resp, err := client.Get(app.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			allowed := resp.StatusCode == http.StatusOK
+			if !allowed && (resp.StatusCode/100 != 3 ||
+				resp.Header.Get("Location") != "/choose") {
+				t.Fatalf("%s: got %s", path, resp.Status)
+			}
+			if allowed != step.allowed[path] {
+				t.Errorf("logged in to %#v: %s allowed %v", step.login, path,
+					allowed)
+			}
+		}
+	}
+}
+
+func TestCurrentIdentityBearer(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+	handler, exists := app.group.Handler("b")
+	if !exists {
+		t.Fatal("no handler for b")
+	}
+	app.mux.Handle("/api", handler.BearerRequired(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id, err := app.group.CurrentIdentity(whcompat.Context(r))
+			if err != nil || id == nil {
+				http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "%s %s", id.Provider, id.Subject)
+		}), whoauth2.UserInfoValidator()))
+
+	token, err := app.idps["b"].Provider("cli", "").DeviceLogin(
+		context.Background(),
+		func(da *whoauth2.DeviceAuth) error {
+			return app.idps["b"].ApproveDevice(da.UserCode)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the bearer token's identity beats the session's.
+	user := app.user()
+	if _, err := app.login(t, user, "a", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	_, body, err := getAPI(user, app.URL+"/api", "Bearer "+token.AccessToken)
+	if err != nil || body != "b alice" {
+		t.Fatalf("got %#v, %v", body, err)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// Error codes from RFC 8628 section 3.5 that a provider may return while a
+// device login is pending.
+const (
+	ErrorAuthorizationPending = "authorization_pending"
+	ErrorSlowDown             = "slow_down"
+	ErrorExpiredToken         = "expired_token"
+)
+
+const (
+	// deviceDefaultInterval is the polling interval RFC 8628 prescribes when
+	// the provider doesn't give one.
+	deviceDefaultInterval = 5 * time.Second
+
+	// deviceMaxBackoff caps the wait between polls after transient errors.
+	deviceMaxBackoff = time.Minute
+)
+
+// DeviceAuth is the provider's answer to a device authorization request. The
+// user has to visit VerificationURI and enter UserCode to approve the login.
+type DeviceAuth struct {
+	DeviceCode      string
+	UserCode        string
+	VerificationURI string
+
+	// VerificationURIComplete, if set, already includes the user code.
+	VerificationURIComplete string
+
+	// Expiry is when DeviceCode stops working.
+	Expiry time.Time
+
+	// Interval is how long to wait between polls of the token endpoint.
+	Interval time.Duration
+}
+
+// DeviceAuth starts a device authorization grant (RFC 8628) for CLI tools and
+// other devices without a browser. It requires the provider's DeviceAuthURL.
+func (p *Provider) DeviceAuth(ctx context.Context) (*DeviceAuth, error) {
+	if p.DeviceAuthURL == "" {
+		return nil, fmt.Errorf("provider %#v has no device authorization url",
+			p.Name)
+	}
+	vals := url.Values{}
+	if len(p.Scopes) > 0 {
+		vals.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	var resp struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURL         string `json:"verification_url"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int64  `json:"expires_in"`
+		Interval                int64  `json:"interval"`
+	}
+	err := p.postForm(ctx, p.DeviceAuthURL, vals, &resp)
+	if err != nil {
+		return nil, err
+	}
+	da := &DeviceAuth{
+		DeviceCode:              resp.DeviceCode,
+		UserCode:                resp.UserCode,
+		VerificationURI:         resp.VerificationURI,
+		VerificationURIComplete: resp.VerificationURIComplete,
+		Expiry: time.Now().Add(
+			time.Duration(resp.ExpiresIn) * time.Second),
+		Interval: time.Duration(resp.Interval) * time.Second}
+	// Google calls it verification_url
+	if da.VerificationURI == "" {
+		da.VerificationURI = resp.VerificationURL
+	}
+	if da.Interval <= 0 {
+		da.Interval = deviceDefaultInterval
+	}
+	if da.DeviceCode == "" || da.UserCode == "" || da.VerificationURI == "" {
+		return nil, fmt.Errorf("incomplete device authorization response")
+	}
+	return da, nil
+}
+
+// DeviceToken polls the token endpoint until the user approves or denies the
+// device login started with DeviceAuth, the device code expires, or ctx is
+// done. slow_down responses lengthen the polling interval as RFC 8628
+// requires, and transient failures are retried with exponential backoff.
+// A denied or expired login returns an *AuthorizationError.
+func (p *Provider) DeviceToken(ctx context.Context, da *DeviceAuth) (
+	*oauth2.Token, error) {
+	return p.pollDeviceToken(ctx, da, sleepContext)
+}
+
+// pollDeviceToken is DeviceToken with sleep waiting between polls.
+func (p *Provider) pollDeviceToken(ctx context.Context, da *DeviceAuth,
+	sleep func(ctx context.Context, d time.Duration) error) (
+	*oauth2.Token, error) {
+	interval := da.Interval
+	backoff := interval
+	for {
+		if !da.Expiry.IsZero() && time.Now().After(da.Expiry) {
+			return nil, &AuthorizationError{Code: ErrorExpiredToken}
+		}
+		token, err := p.deviceTokenRequest(ctx, da)
+		if err == nil {
+			return token, nil
+		}
+		wait := interval
+		switch err := err.(type) {
+		case *AuthorizationError:
+			switch err.Code {
+			case ErrorAuthorizationPending:
+				backoff = interval
+			case ErrorSlowDown:
+				interval += 5 * time.Second
+				backoff = interval
+				wait = interval
+			default:
+				return nil, err
+			}
+		default:
+			// network problems or server errors, back off and retry.
+			backoff *= 2
+			if backoff > deviceMaxBackoff {
+				backoff = deviceMaxBackoff
+			}
+			wait = backoff
+		}
+		err = sleep(ctx, wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// DeviceLogin runs a whole device login: it starts it with DeviceAuth, calls
+// show so the user learns where to go and which code to enter, and waits for
+// the token with DeviceToken. If show is nil, instructions are printed to
+// os.Stderr.
+func (p *Provider) DeviceLogin(ctx context.Context,
+	show func(da *DeviceAuth) error) (*oauth2.Token, error) {
+	da, err := p.DeviceAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if show == nil {
+		show = func(da *DeviceAuth) error {
+			return PrintDeviceAuth(os.Stderr, da)
+		}
+	}
+	err = show(da)
+	if err != nil {
+		return nil, err
+	}
+	return p.DeviceToken(ctx, da)
+}
+
+// PrintDeviceAuth writes instructions for approving a device login to w.
+func PrintDeviceAuth(w io.Writer, da *DeviceAuth) error {
+	_, err := fmt.Fprintf(w, "To log in, visit %s and enter the code %s\n",
+		da.VerificationURI, da.UserCode)
+	if err == nil && da.VerificationURIComplete != "" {
+		_, err = fmt.Fprintf(w, "or open %s\n", da.VerificationURIComplete)
+	}
+	return err
+}
+
+func (p *Provider) deviceTokenRequest(ctx context.Context, da *DeviceAuth) (
+	*oauth2.Token, error) {
+	var raw map[string]interface{}
+	err := p.postForm(ctx, p.Endpoint.TokenURL, url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {da.DeviceCode}}, &raw)
+	if err != nil {
+		return nil, err
+	}
+	access_token, _ := raw["access_token"].(string)
+	if access_token == "" {
+		return nil, fmt.Errorf("token response has no access_token")
+	}
+	token := &oauth2.Token{AccessToken: access_token}
+	token.TokenType, _ = raw["token_type"].(string)
+	token.RefreshToken, _ = raw["refresh_token"].(string)
+	if expires_in, ok := raw["expires_in"].(float64); ok && expires_in > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expires_in) * time.Second)
+	}
+	return token.WithExtra(raw), nil
+}
+
+// postForm posts vals to endpoint with the provider's client credentials and
+// decodes the JSON response into val. OAuth2 error responses are returned as
+// *AuthorizationErrors.
+func (p *Provider) postForm(ctx context.Context, endpoint string,
+	vals url.Values, val interface{}) error {
+	p, err := p.withSecret(ctx)
+	if err != nil {
+		return err
+	}
+	vals.Set("client_id", p.ClientID)
+	basic := p.ClientSecret != "" &&
+		p.Endpoint.AuthStyle != oauth2.AuthStyleInParams
+	if p.ClientSecret != "" && !basic {
+		vals.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequest("POST", endpoint,
+		strings.NewReader(vals.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID),
+			url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := contextClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	media_type, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var e struct {
+		Code        string `json:"error"`
+		Description string `json:"error_description"`
+		URI         string `json:"error_uri"`
+	}
+	if media_type == "application/json" &&
+		json.Unmarshal(body, &e) == nil && e.Code != "" {
+		return &AuthorizationError{
+			Code: e.Code, Description: e.Description, URI: e.URI}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", endpoint,
+			resp.Status)
+	}
+	return json.Unmarshal(body, val)
+}
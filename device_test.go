@@ -0,0 +1,176 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+)
+
+func TestDeviceLogin(t *testing.T) {
+	server := whoauth2test.NewDeviceServer()
+	defer server.Close()
+	provider := server.Provider("device")
+
+	for _, approve := range []bool{true, false} {
+		token, err := provider.DeviceLogin(context.Background(),
+			func(da *whoauth2.DeviceAuth) error {
+				if da.VerificationURIComplete == "" ||
+					da.Interval != time.Second {
+					t.Errorf("got device auth %+v", da)
+				}
+				if approve {
+					return server.Approve(da.UserCode)
+				}
+				return server.Deny(da.UserCode)
+			})
+		if approve {
+			if err != nil || token.AccessToken == "" {
+				t.Errorf("approved: got %v, %v", token, err)
+			}
+			continue
+		}
+		auth_err, ok := err.(*whoauth2.AuthorizationError)
+		if !ok || auth_err.Code != whoauth2.ErrorAccessDenied {
+			t.Errorf("denied: got %v, %v", token, err)
+		}
+	}
+}
+
+func TestDeviceTokenPending(t *testing.T) {
+	server := whoauth2test.NewDeviceServer()
+	defer server.Close()
+	provider := server.Provider("device")
+
+	ctx := context.Background()
+	da, err := provider.DeviceAuth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = provider.DeviceToken(ctx, da)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass while pending, got %v", err)
+	}
+
+	// the code still works once the user gets around to it.
+	err = server.Approve(da.UserCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := provider.DeviceToken(context.Background(), da)
+	if err != nil || token.AccessToken == "" {
+		t.Fatalf("got %v, %v", token, err)
+	}
+	// device codes are single use.
+	if err := server.Approve(da.UserCode); err == nil {
+		t.Fatalf("approved a used code")
+	}
+}
+
+// recordWaits returns a sleep function for PollDeviceToken that returns
+// right away, adding each wait to waits.
+func recordWaits(waits *[]time.Duration) func(context.Context,
+	time.Duration) error {
+	return func(ctx context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		return nil
+	}
+}
+
+func TestDeviceTokenSlowDown(t *testing.T) {
+	server := whoauth2test.NewDeviceServer()
+	defer server.Close()
+	provider := server.Provider("device")
+	server.SetSlowDown(2)
+
+	ctx := context.Background()
+	da, err := provider.DeviceAuth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the user approves before the server is done asking to slow down.
+	err = server.Approve(da.UserCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var waits []time.Duration
+	token, err := whoauth2.PollDeviceToken(provider, ctx, da,
+		recordWaits(&waits))
+	if err != nil || token.AccessToken == "" {
+		t.Fatalf("got %v, %v", token, err)
+	}
+	// every slow_down adds five seconds to the interval.
+	want := []time.Duration{6 * time.Second, 11 * time.Second}
+	if !reflect.DeepEqual(waits, want) {
+		t.Fatalf("got waits %v, want %v", waits, want)
+	}
+}
+
+func TestDeviceTokenBackoff(t *testing.T) {
+	// each poll gets the next response: an OAuth2 error code, "unavailable"
+	// for a 503, or "" for a token.
+	responses := []string{
+		whoauth2.ErrorSlowDown, "unavailable", "unavailable",
+		whoauth2.ErrorAuthorizationPending, "unavailable", "unavailable",
+		"unavailable", "unavailable", ""}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			response := responses[0]
+			responses = responses[1:]
+			switch response {
+			case "unavailable":
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			case "":
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"access_token": "token"}`)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, response)
+		}))
+	defer server.Close()
+	provider := &whoauth2.Provider{Name: "device", Config: oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{TokenURL: server.URL}}}
+
+	var waits []time.Duration
+	token, err := whoauth2.PollDeviceToken(provider, context.Background(),
+		&whoauth2.DeviceAuth{DeviceCode: "code", Interval: time.Second},
+		recordWaits(&waits))
+	if err != nil || token.AccessToken != "token" {
+		t.Fatalf("got %v, %v", token, err)
+	}
+	// failures double the wait up to a minute, and a pending answer goes
+	// back to the interval, which slow_down raised to six seconds.
+	want := []time.Duration{6 * time.Second, 12 * time.Second,
+		24 * time.Second, 6 * time.Second, 12 * time.Second, 24 * time.Second,
+		48 * time.Second, time.Minute}
+	if !reflect.DeepEqual(waits, want) {
+		t.Fatalf("got waits %v, want %v", waits, want)
+	}
+}
+
+func TestDeviceAuthCustomGithub(t *testing.T) {
+	// only github.com's device endpoint is known.
+	provider := whoauth2.Github(whoauth2.Config{Endpoint: oauth2.Endpoint{
+		AuthURL:  "https://github.example.com/login/oauth/authorize",
+		TokenURL: "https://github.example.com/login/oauth/access_token"}})
+	_, err := provider.DeviceAuth(context.Background())
+	if err == nil {
+		t.Fatalf("expected an error without a device authorization url")
+	}
+}
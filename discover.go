@@ -0,0 +1,125 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// providerMetadata is the subset of OpenID Connect Discovery 1.0 metadata
+// whoauth2 uses.
+type providerMetadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	UserInfoEndpoint              string   `json:"userinfo_endpoint"`
+	JWKSURI                       string   `json:"jwks_uri"`
+	RevocationEndpoint            string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint         string   `json:"introspection_endpoint"`
+	DeviceAuthorizationEndpoint   string   `json:"device_authorization_endpoint"`
+	ScopesSupported               []string `json:"scopes_supported"`
+	TokenEndpointAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+}
+
+func fetchMetadata(ctx context.Context, issuer string) (
+	*providerMetadata, error) {
+	issuer = strings.TrimRight(issuer, "/")
+	var md providerMetadata
+	err := getJSON(ctx, contextClient(ctx),
+		issuer+"/.well-known/openid-configuration", &md)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(md.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("issuer %#v does not match discovery url %#v",
+			md.Issuer, issuer)
+	}
+	if md.JWKSURI == "" {
+		return nil, fmt.Errorf("issuer %#v publishes no jwks_uri", issuer)
+	}
+	return &md, nil
+}
+
+// defaultScopes are requested by discovered providers when the Config
+// doesn't list any scopes, as far as the issuer supports them.
+var defaultScopes = []string{"openid", "email", "profile"}
+
+// Discover makes an OpenID Connect provider by reading the issuer's
+// /.well-known/openid-configuration. conf's endpoint URLs, auth style and
+// scopes are filled in from the metadata where conf leaves them empty, and
+// openid is added to scopes that lack it. User info, revocation,
+// introspection and device authorization are set up from whichever of those
+// endpoints the metadata lists; change the Provider's fields afterwards to
+// override them. The provider is named after the issuer's host; change Name
+// if you need something else.
+func Discover(ctx context.Context, issuer_url string, conf Config) (
+	*Provider, error) {
+	md, err := fetchMetadata(ctx, issuer_url)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(md.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.Endpoint.AuthURL == "" {
+		conf.Endpoint.AuthURL = md.AuthorizationEndpoint
+	}
+	if conf.Endpoint.TokenURL == "" {
+		conf.Endpoint.TokenURL = md.TokenEndpoint
+	}
+	if conf.Endpoint.AuthStyle == oauth2.AuthStyleAutoDetect {
+		conf.Endpoint.AuthStyle = authStyle(md.TokenEndpointAuthMethods)
+	}
+	if len(conf.Scopes) == 0 {
+		for _, scope := range defaultScopes {
+			if len(md.ScopesSupported) == 0 ||
+				contains(md.ScopesSupported, scope) {
+				conf.Scopes = append(conf.Scopes, scope)
+			}
+		}
+	} else if !contains(conf.Scopes, "openid") {
+		conf.Scopes = append([]string{"openid"}, conf.Scopes...)
+	}
+
+	p := &Provider{
+		Name:   u.Host,
+		Config: oauth2.Config(conf),
+		OIDC:   NewOIDC(md.Issuer, md.JWKSURI)}
+	// only turn PKCE off if the issuer says which methods it supports and
+	// S256 isn't one of them.
+	if len(md.CodeChallengeMethodsSupported) > 0 &&
+		!contains(md.CodeChallengeMethodsSupported, "S256") {
+		p.DisablePKCE = true
+	}
+	if md.UserInfoEndpoint != "" {
+		p.FetchUserInfo = OIDCUserInfo(md.UserInfoEndpoint)
+	}
+	if md.RevocationEndpoint != "" {
+		p.Revoke = RFC7009Revoker(md.RevocationEndpoint)
+	}
+	p.IntrospectionURL = md.IntrospectionEndpoint
+	p.DeviceAuthURL = md.DeviceAuthorizationEndpoint
+	return p, nil
+}
+
+// authStyle picks how to authenticate to the token endpoint given the
+// issuer's token_endpoint_auth_methods_supported.
+func authStyle(methods []string) oauth2.AuthStyle {
+	// client_secret_basic is the default when the issuer doesn't say.
+	if len(methods) == 0 || contains(methods, "client_secret_basic") {
+		return oauth2.AuthStyleInHeader
+	}
+	if contains(methods, "client_secret_post") {
+		return oauth2.AuthStyleInParams
+	}
+	return oauth2.AuthStyleAutoDetect
+}
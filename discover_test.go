@@ -0,0 +1,141 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// discoveryServer serves the metadata that metadata returns for the
+// server's URL at /.well-known/openid-configuration.
+func discoveryServer(
+	metadata func(server_url string) map[string]interface{}) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/.well-known/openid-configuration" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(metadata(server.URL))
+		}))
+	return server
+}
+
+func TestDiscover(t *testing.T) {
+	server := discoveryServer(func(u string) map[string]interface{} {
+		return map[string]interface{}{
+			"issuer":                                u,
+			"authorization_endpoint":                u + "/authorize",
+			"token_endpoint":                        u + "/token",
+			"userinfo_endpoint":                     u + "/userinfo",
+			"jwks_uri":                              u + "/jwks",
+			"revocation_endpoint":                   u + "/revoke",
+			"introspection_endpoint":                u + "/introspect",
+			"device_authorization_endpoint":         u + "/device",
+			"scopes_supported":                      []string{"openid", "email"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_post"},
+			"code_challenge_methods_supported":      []string{"S256"}}
+	})
+	defer server.Close()
+
+	p, err := Discover(context.Background(), server.URL+"/",
+		Config{ClientID: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := url.Parse(server.URL)
+	if p.Name != host.Host {
+		t.Errorf("got name %#v", p.Name)
+	}
+	want := oauth2.Endpoint{
+		AuthURL:   server.URL + "/authorize",
+		TokenURL:  server.URL + "/token",
+		AuthStyle: oauth2.AuthStyleInParams}
+	if p.Endpoint != want {
+		t.Errorf("got endpoint %+v", p.Endpoint)
+	}
+	if !reflect.DeepEqual(p.Scopes, []string{"openid", "email"}) {
+		t.Errorf("got scopes %v", p.Scopes)
+	}
+	if p.OIDC == nil || p.OIDC.Issuer != server.URL ||
+		p.OIDC.JWKSURL != server.URL+"/jwks" {
+		t.Errorf("got OIDC %+v", p.OIDC)
+	}
+	if p.FetchUserInfo == nil || p.Revoke == nil || p.DisablePKCE ||
+		p.IntrospectionURL != server.URL+"/introspect" ||
+		p.DeviceAuthURL != server.URL+"/device" {
+		t.Errorf("got provider %+v", p)
+	}
+}
+
+func TestDiscoverConfig(t *testing.T) {
+	server := discoveryServer(func(u string) map[string]interface{} {
+		return map[string]interface{}{
+			"issuer":                           u,
+			"authorization_endpoint":           u + "/authorize",
+			"token_endpoint":                   u + "/token",
+			"jwks_uri":                         u + "/jwks",
+			"code_challenge_methods_supported": []string{"plain"}}
+	})
+	defer server.Close()
+
+	p, err := Discover(context.Background(), server.URL, Config{
+		Endpoint: oauth2.Endpoint{AuthURL: "https://example.com/auth"},
+		Scopes:   []string{"email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Endpoint.AuthURL != "https://example.com/auth" ||
+		p.Endpoint.TokenURL != server.URL+"/token" ||
+		p.Endpoint.AuthStyle != oauth2.AuthStyleInHeader {
+		t.Errorf("got endpoint %+v", p.Endpoint)
+	}
+	if !reflect.DeepEqual(p.Scopes, []string{"openid", "email"}) {
+		t.Errorf("got scopes %v", p.Scopes)
+	}
+	if !p.DisablePKCE {
+		t.Errorf("PKCE not disabled without S256 support")
+	}
+	if p.FetchUserInfo != nil || p.Revoke != nil || p.DeviceAuthURL != "" {
+		t.Errorf("got endpoints the issuer doesn't have: %+v", p)
+	}
+}
+
+func TestDiscoverErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		metadata func(u string) map[string]interface{}
+	}{
+		{"other issuer", func(u string) map[string]interface{} {
+			return map[string]interface{}{
+				"issuer":   "https://issuer.example.com",
+				"jwks_uri": u + "/jwks"}
+		}},
+		{"no jwks_uri", func(u string) map[string]interface{} {
+			return map[string]interface{}{"issuer": u}
+		}},
+	} {
+		server := discoveryServer(test.metadata)
+		_, err := Discover(context.Background(), server.URL, Config{})
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		server.Close()
+	}
+
+	_, err := Discover(context.Background(), "http://127.0.0.1:1", Config{})
+	if err == nil {
+		t.Errorf("unreachable: expected an error")
+	}
+}
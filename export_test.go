@@ -0,0 +1,8 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+// PollDeviceToken is DeviceToken with sleep waiting between polls, for the
+// whoauth2_test package.
+var PollDeviceToken = (*Provider).pollDeviceToken
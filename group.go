@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/spacemonkeygo/errors"
 	"golang.org/x/net/context"
@@ -17,6 +18,7 @@ import (
 	"gopkg.in/webhelp.v1/whmux"
 	"gopkg.in/webhelp.v1/whredir"
 	"gopkg.in/webhelp.v1/whroute"
+	"gopkg.in/webhelp.v1/whsess"
 )
 
 // ProviderGroup is an http.Handler that keeps track of authentication for
@@ -24,28 +26,38 @@ import (
 //
 // Assuming OAuth2 providers have been configured for Facebook, Google,
 // LinkedIn, and Github, ProviderGroup handles requests to the following paths:
-//  * /all/logout
-//  * /facebook/login
-//  * /facebook/logout
-//  * /facebook/_cb
-//  * /google/login
-//  * /google/logout
-//  * /google/_cb
-//  * /linkedin/login
-//  * /linkedin/logout
-//  * /linkedin/_cb
-//  * /github/login
-//  * /github/logout
-//  * /github/_cb
+//   - /all/logout
+//   - /all/status
+//   - /facebook/login
+//   - /facebook/logout
+//   - /facebook/status
+//   - /facebook/_cb
+//   - /google/login
+//   - /google/logout
+//   - /google/status
+//   - /google/_cb
+//   - /linkedin/login
+//   - /linkedin/logout
+//   - /linkedin/status
+//   - /linkedin/_cb
+//   - /github/login
+//   - /github/logout
+//   - /github/status
+//   - /github/_cb
+//
+// /all/status returns a JSON GroupStatus covering every provider.
 //
 // ProviderGroup will also return associated state to you about each OAuth2
 // provider's state, in addition to a LoginRequired middleware and a Login
 // URL generator.
 type ProviderGroup struct {
-	handlers       map[string]*ProviderHandler
-	mux            whmux.Dir
-	urls           RedirectURLs
-	group_base_url string
+	handlers          map[string]*ProviderHandler
+	mux               whmux.Dir
+	urls              RedirectURLs
+	session_namespace string
+	group_base_url    string
+	hooks             Hooks
+	identities        IdentityStore
 }
 
 // NewProviderGroup makes a provider group. Requires a session namespace (will
@@ -56,15 +68,23 @@ func NewProviderGroup(session_namespace string, group_base_url string,
 	urls RedirectURLs, providers ...*Provider) (*ProviderGroup, error) {
 
 	group_base_url = strings.TrimRight(group_base_url, "/")
+	if urls.DefaultLoginURL == "" {
+		urls.DefaultLoginURL = "/"
+	}
+	if urls.DefaultLogoutURL == "" {
+		urls.DefaultLogoutURL = "/"
+	}
 
 	g := &ProviderGroup{
-		handlers:       make(map[string]*ProviderHandler, len(providers)),
-		urls:           urls,
-		group_base_url: group_base_url}
+		handlers:          make(map[string]*ProviderHandler, len(providers)),
+		urls:              urls,
+		session_namespace: session_namespace,
+		group_base_url:    group_base_url}
 
 	g.mux = whmux.Dir{
-		"all": whmux.Dir{"logout": whmux.Exact(
-			http.HandlerFunc(g.logoutAll))},
+		"all": whmux.Dir{
+			"logout": whmux.Exact(http.HandlerFunc(g.logoutAll)),
+			"status": whmux.Exact(http.HandlerFunc(g.status))},
 	}
 
 	for _, provider := range providers {
@@ -79,6 +99,7 @@ func NewProviderGroup(session_namespace string, group_base_url string,
 		handler := NewProviderHandler(provider,
 			fmt.Sprintf("%s-%s", session_namespace, provider.Name),
 			fmt.Sprintf("%s/%s", group_base_url, provider.Name), urls)
+		handler.on_identity = g.onIdentity
 		g.handlers[provider.Name] = handler
 		g.mux[provider.Name] = handler
 	}
@@ -115,6 +136,23 @@ func (g *ProviderGroup) LoginURL(provider_name, redirect_to string,
 	return g.handlers[provider_name].LoginURL(redirect_to, force_prompt)
 }
 
+// AttachURL returns the URL for attaching a provider to the account the user
+// is logged in as. Unlike a login through LoginURL, the identity the user
+// logs in with is linked to the account if it isn't linked yet. The provider
+// always prompts, so the user can pick which of their identities to attach.
+// The URL carries a one-time token bound to the user's session, so links
+// made for anyone else, or by other sites, can't attach identities. The
+// token is saved to the session using w, so AttachURL should be called
+// before the response headers are written. See SetIdentityStore.
+func (g *ProviderGroup) AttachURL(ctx context.Context, w http.ResponseWriter,
+	provider_name, redirect_to string) (string, error) {
+	handler, exists := g.handlers[provider_name]
+	if !exists {
+		return "", wherr.NotFound.New("unknown provider %#v", provider_name)
+	}
+	return handler.attachURL(ctx, w, redirect_to)
+}
+
 // LogoutURL returns the logout URL for a given provider.
 // redirect_to is the URL to navigate to after logging out.
 func (g *ProviderGroup) LogoutURL(provider_name, redirect_to string) string {
@@ -143,6 +181,38 @@ func (g *ProviderGroup) Tokens(ctx context.Context) (map[string]*oauth2.Token,
 	return rv, errs.Finalize()
 }
 
+// Claims will return a map of the ID token claims for every logged in
+// provider that is in OIDC mode.
+func (g *ProviderGroup) Claims(ctx context.Context) (map[string]*Claims,
+	error) {
+	rv := make(map[string]*Claims)
+	var errs errors.ErrorGroup
+	for name, handler := range g.handlers {
+		claims, err := handler.Claims(ctx)
+		errs.Add(err)
+		if err == nil && claims != nil {
+			rv[name] = claims
+		}
+	}
+	return rv, errs.Finalize()
+}
+
+// UserInfo will return a map of the profiles of every logged in provider that
+// fetches user info.
+func (g *ProviderGroup) UserInfo(ctx context.Context) (map[string]*UserInfo,
+	error) {
+	rv := make(map[string]*UserInfo)
+	var errs errors.ErrorGroup
+	for name, handler := range g.handlers {
+		info, err := handler.UserInfo(ctx)
+		errs.Add(err)
+		if err == nil && info != nil {
+			rv[name] = info
+		}
+	}
+	return rv, errs.Finalize()
+}
+
 // Providers will return a map of all the currently known providers.
 func (g *ProviderGroup) Providers() map[string]*ProviderHandler {
 	copy := make(map[string]*ProviderHandler, len(g.handlers))
@@ -158,16 +228,58 @@ func (g *ProviderGroup) LoggedIn(ctx context.Context) (bool, error) {
 	return len(t) > 0, err
 }
 
+// SetStateTTL sets how long a user has to finish logging in for every
+// provider's handler. See (*ProviderHandler).SetStateTTL.
+func (g *ProviderGroup) SetStateTTL(ttl time.Duration) {
+	for _, handler := range g.handlers {
+		handler.SetStateTTL(ttl)
+	}
+}
+
+// SetRevocationPolicy sets the RevocationPolicy of every provider's handler.
+// See (*ProviderHandler).SetRevocationPolicy.
+func (g *ProviderGroup) SetRevocationPolicy(policy RevocationPolicy) {
+	for _, handler := range g.handlers {
+		handler.SetRevocationPolicy(policy)
+	}
+}
+
 // LogoutAll will not return any HTTP response, but will simply prepare a
 // response for logging a user out completely from all providers. If a user
 // should log out of just a specific OAuth2 provider, use the Logout method
 // on the associated ProviderHandler.
+//
+// Every provider's token is revoked before anything is cleared, subject to
+// each handler's RevocationPolicy. If a policy fails the logout, as
+// StrictRevocation does when a revocation fails, the user stays logged in
+// to every provider and LogoutAll returns the error, so they can try again.
+// Tokens that were revoked before the failure stay in their sessions, but
+// the providers no longer honor them.
 func (g *ProviderGroup) LogoutAll(ctx context.Context,
 	w http.ResponseWriter) error {
 	var errs errors.ErrorGroup
+	sessions := make(map[*ProviderHandler]*whsess.Session, len(g.handlers))
 	for _, handler := range g.handlers {
-		errs.Add(handler.Logout(ctx, w))
+		session, err := handler.Session(ctx)
+		if err == nil {
+			sessions[handler] = session
+			err = handler.revoke(ctx, session)
+		}
+		errs.Add(err)
+	}
+	err := errs.Finalize()
+	if err != nil {
+		return err
+	}
+
+	for handler, session := range sessions {
+		errs.Add(handler.clearSession(ctx, w, session))
+	}
+	session, err := g.Session(ctx)
+	if err == nil {
+		err = session.Clear(ctx, w)
 	}
+	errs.Add(err)
 	return errs.Finalize()
 }
 
@@ -177,9 +289,10 @@ func (g *ProviderGroup) logoutAll(w http.ResponseWriter, r *http.Request) {
 		wherr.Handle(w, r, err)
 		return
 	}
-	redirect_to := r.FormValue("redirect_to")
-	if redirect_to == "" {
-		redirect_to = g.urls.DefaultLogoutURL
+	redirect_to := g.urls.redirectTarget(r, r.FormValue("redirect_to"),
+		g.urls.DefaultLogoutURL)
+	if g.hooks.OnLogout != nil {
+		redirect_to = g.hooks.OnLogout(whcompat.Context(r), nil, redirect_to)
 	}
 	whredir.Redirect(w, r, redirect_to)
 }
@@ -189,20 +302,10 @@ func (g *ProviderGroup) logoutAll(w http.ResponseWriter, r *http.Request) {
 // to after logging in and return a URL that will actually do the logging in.
 // If you already know which provider a user should use, consider using
 // (*ProviderHandler).LoginRequired instead, which doesn't require a
-// login_redirect URL.
+// login_redirect URL. Requests that accept application/json get a 401 with a
+// JSON body containing the login URL instead of a redirect. See
+// LoginRequiredPolicy for requiring logins with specific providers.
 func (g *ProviderGroup) LoginRequired(h http.Handler,
 	login_redirect func(redirect_to string) (url string)) http.Handler {
-	return whroute.HandlerFunc(h,
-		func(w http.ResponseWriter, r *http.Request) {
-			tokens, err := g.Tokens(whcompat.Context(r))
-			if err != nil {
-				wherr.Handle(w, r, err)
-				return
-			}
-			if len(tokens) <= 0 {
-				whredir.Redirect(w, r, login_redirect(r.RequestURI))
-				return
-			}
-			h.ServeHTTP(w, r)
-		})
+	return g.LoginRequiredPolicy(h, RequireAny(), login_redirect)
 }
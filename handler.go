@@ -6,10 +6,12 @@ package whoauth2 // import "gopkg.in/go-webhelp/whoauth2.v1"
 import (
 	"encoding/gob"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -29,9 +31,13 @@ func init() {
 // a single OAuth2 provider
 //
 // ProviderHandler handles requests to the following paths:
-//  * /login
-//  * /logout
-//  * /_cb
+//   - /login
+//   - /logout
+//   - /status
+//   - /_cb
+//
+// /status returns a JSON ProviderStatus for single-page apps and other API
+// clients.
 //
 // ProviderHandler will also return associated state to you about its state,
 // in addition to a LoginRequired middleware and a Login URL generator.
@@ -41,6 +47,14 @@ type ProviderHandler struct {
 	handler_base_url  string
 	urls              RedirectURLs
 	accessOffline     bool
+	state_ttl         time.Duration
+	revocation        RevocationPolicy
+	store             TokenStore
+	keys              *KeyRing
+	hooks             Hooks
+	on_identity       identityHook
+	allowed_scopes    []string
+	refresher         refresher
 	whmux.Dir
 }
 
@@ -59,10 +73,13 @@ func NewProviderHandler(provider *Provider, session_namespace string,
 		provider:          provider,
 		session_namespace: session_namespace,
 		handler_base_url:  strings.TrimRight(handler_base_url, "/"),
-		urls:              urls}
+		urls:              urls,
+		state_ttl:         DefaultStateTTL,
+		revocation:        BestEffortRevocation(nil)}
 	h.Dir = whmux.Dir{
 		"login":  whmux.Exact(http.HandlerFunc(h.login)),
 		"logout": whmux.Exact(http.HandlerFunc(h.logout)),
+		"status": whmux.Exact(http.HandlerFunc(h.status)),
 		"_cb":    whmux.Exact(http.HandlerFunc(h.cb))}
 	return h
 }
@@ -73,13 +90,35 @@ func (o *ProviderHandler) RequestOfflineTokens() {
 	o.accessOffline = true
 }
 
+// SetStateTTL sets how long a user has to finish logging in with the
+// provider. Callbacks that arrive later fail with a StateExpired error.
+func (o *ProviderHandler) SetStateTTL(ttl time.Duration) {
+	o.state_ttl = ttl
+}
+
+// SetRevocationPolicy controls what happens when the provider's Revoke call
+// fails during logout. The default is BestEffortRevocation(nil).
+func (o *ProviderHandler) SetRevocationPolicy(policy RevocationPolicy) {
+	o.revocation = policy
+}
+
 // Token returns a token if the provider is currently logged in, or nil if not.
+// For requests authenticated by BearerRequired this is the bearer token.
+// An expired token is refreshed if a refresh token is available (see
+// RequestOfflineTokens). Unless the handler has a TokenStore, the refreshed
+// token has to be saved to the session, which is only possible for requests
+// that came through LoginRequired, RequireScopes, BearerOrLoginRequired or
+// SaveRefreshedTokens; for others, an expired token is not refreshed and
+// the user counts as logged out.
 func (o *ProviderHandler) Token(ctx context.Context) (*oauth2.Token, error) {
+	if id, ok := o.bearerIdentity(ctx); ok {
+		return id.Token, nil
+	}
 	session, err := o.Session(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return o.token(session), nil
+	return o.token(ctx, session)
 }
 
 func (o *ProviderHandler) Provider() *Provider { return o.provider }
@@ -97,24 +136,109 @@ func (o *ProviderHandler) LoggedIn(ctx context.Context) (bool, error) {
 	return t != nil, err
 }
 
-func (o *ProviderHandler) token(session *whsess.Session) *oauth2.Token {
-	val, exists := session.Values["_token"]
-	token, correct := val.(*oauth2.Token)
-	if exists && correct && token.Valid() {
-		return token
+// Claims returns the verified ID token claims for the logged in user, or nil
+// if the user isn't logged in or the provider isn't in OIDC mode.
+func (o *ProviderHandler) Claims(ctx context.Context) (*Claims, error) {
+	id, err := o.Identity(ctx)
+	if err != nil || id == nil {
+		return nil, err
+	}
+	return id.Claims, nil
+}
+
+// UserInfo returns the profile fetched with the provider's FetchUserInfo when
+// the user logged in, or nil if the user isn't logged in, the provider has no
+// FetchUserInfo, or fetching the profile failed (see Hooks.OnUserInfoError).
+func (o *ProviderHandler) UserInfo(ctx context.Context) (*UserInfo, error) {
+	id, err := o.Identity(ctx)
+	if err != nil || id == nil {
+		return nil, err
 	}
-	return nil
+	return id.UserInfo, nil
+}
+
+func (o *ProviderHandler) token(ctx context.Context,
+	session *whsess.Session) (*oauth2.Token, error) {
+	token, err := o.storedToken(ctx, session)
+	if err != nil || token == nil {
+		return nil, err
+	}
+	if token.Valid() {
+		return token, nil
+	}
+	if token.RefreshToken == "" {
+		return nil, nil
+	}
+	// providers may rotate refresh tokens, so a refreshed token that isn't
+	// saved can log the user out. Without a way to save it, the token counts
+	// as logged out, like any expired token.
+	w, can_save := responseWriter(ctx)
+	if o.store == nil && !can_save {
+		return nil, nil
+	}
+	token, err = o.refresher.refresh(ctx, o.provider, token)
+	if err != nil {
+		if !refreshRejected(err) {
+			return nil, err
+		}
+		// the provider no longer honors the refresh token, so the user is
+		// logged out and the token is dropped so it isn't tried again.
+		token = nil
+		err = o.dropToken(ctx, session)
+	} else {
+		err = o.putToken(ctx, session, token)
+	}
+	if err == nil && can_save {
+		err = session.Save(ctx, w)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
 // Logout prepares the request to log the user out of just this OAuth2
-// provider. If you're using a ProviderGroup you may be interested in
-// LogoutAll.
+// provider. If the provider can revoke tokens, the user's token is revoked
+// first, subject to the handler's RevocationPolicy. If you're using a
+// ProviderGroup you may be interested in LogoutAll.
 func (o *ProviderHandler) Logout(ctx context.Context,
 	w http.ResponseWriter) error {
 	session, err := o.Session(ctx)
 	if err != nil {
 		return err
 	}
+	err = o.revoke(ctx, session)
+	if err != nil {
+		return err
+	}
+	return o.clearSession(ctx, w, session)
+}
+
+// revoke revokes the user's token at the provider if it can. It only fails
+// if the handler's RevocationPolicy fails the logout.
+func (o *ProviderHandler) revoke(ctx context.Context,
+	session *whsess.Session) error {
+	token, err := o.storedToken(ctx, session)
+	if err != nil || token == nil || o.provider.Revoke == nil {
+		return err
+	}
+	provider, err := o.provider.withSecret(ctx)
+	if err == nil {
+		err = o.provider.Revoke(ctx, provider, token)
+	}
+	if err != nil {
+		return o.revocation(ctx, o.provider, err)
+	}
+	return nil
+}
+
+// clearSession deletes the user's token and clears the handler's session.
+func (o *ProviderHandler) clearSession(ctx context.Context,
+	w http.ResponseWriter, session *whsess.Session) error {
+	err := o.deleteToken(ctx, session)
+	if err != nil {
+		return err
+	}
 	return session.Clear(ctx, w)
 }
 
@@ -124,9 +248,24 @@ func (o *ProviderHandler) Logout(ctx context.Context,
 // regardless of if the user is already logged in.
 func (o *ProviderHandler) LoginURL(redirect_to string,
 	force_prompt bool) string {
-	return o.handler_base_url + "/login?" + url.Values{
+	return o.loginURL(redirect_to, force_prompt, nil, "")
+}
+
+// loginURL is LoginURL with extra scopes to request on top of the
+// provider's. If attach_token is set, the login attaches the identity to the
+// user's account. See (*ProviderGroup).AttachURL.
+func (o *ProviderHandler) loginURL(redirect_to string, force_prompt bool,
+	scopes []string, attach_token string) string {
+	vals := url.Values{
 		"redirect_to":  {redirect_to},
-		"force_prompt": {fmt.Sprint(force_prompt)}}.Encode()
+		"force_prompt": {fmt.Sprint(force_prompt)}}
+	if len(scopes) > 0 {
+		vals.Set("scope", strings.Join(scopes, " "))
+	}
+	if attach_token != "" {
+		vals.Set("attach", attach_token)
+	}
+	return o.handler_base_url + "/login?" + vals.Encode()
 }
 
 // LogoutURL returns the logout URL for this provider
@@ -137,38 +276,87 @@ func (o *ProviderHandler) LogoutURL(redirect_to string) string {
 }
 
 func (o *ProviderHandler) login(w http.ResponseWriter, r *http.Request) {
+	r = withResponseWriter(r, w)
 	ctx := whcompat.Context(r)
 	session, err := o.Session(ctx)
 	if err != nil {
-		wherr.Handle(w, r, err)
+		o.loginError(w, r, err)
 		return
 	}
 
-	redirect_to := r.FormValue("redirect_to")
-	if redirect_to == "" {
-		redirect_to = o.urls.DefaultLoginURL
-	}
+	redirect_to := o.urls.redirectTarget(r, r.FormValue("redirect_to"),
+		o.urls.DefaultLoginURL)
 
 	force_prompt, err := strconv.ParseBool(r.FormValue("force_prompt"))
 	if err != nil {
 		force_prompt = false
 	}
+	attach := r.FormValue("attach") != ""
+	if attach {
+		if !useAttachToken(session, r.FormValue("attach")) {
+			o.loginError(w, r, InvalidAttach.New("%s", o.provider.Name))
+			return
+		}
+		// the user always gets to pick which identity is attached.
+		force_prompt = true
+	}
 
-	if !force_prompt && o.token(session) != nil {
+	token, err := o.token(ctx, session)
+	if err != nil {
+		o.loginError(w, r, err)
+		return
+	}
+	extra_scopes := strings.Fields(r.FormValue("scope"))
+	err = o.checkScopes(extra_scopes)
+	if err != nil {
+		o.loginError(w, r, err)
+		return
+	}
+	if token != nil && !force_prompt &&
+		len(missingScopes(o.scopes(session), extra_scopes)) == 0 {
 		whredir.Redirect(w, r, redirect_to)
 		return
 	}
 
+	// ask for what the user already granted as well, so providers that
+	// don't support incremental authorization don't drop earlier scopes.
+	conf := o.provider.Config
+	if len(extra_scopes) > 0 {
+		var granted []string
+		if token != nil {
+			granted = o.scopes(session)
+		}
+		conf.Scopes = unionScopes(o.provider.Scopes, granted, extra_scopes)
+	}
+
 	state := newState()
-	session.Values["_state"] = state
-	session.Values["_redirect_to"] = redirect_to
+	pending := &pendingLogin{
+		RedirectTo: redirect_to,
+		Scopes:     conf.Scopes,
+		Attach:     attach,
+		Created:    time.Now()}
+	if !o.provider.DisablePKCE {
+		pending.Verifier = newCodeVerifier()
+	}
+	if o.provider.OIDC != nil {
+		pending.Nonce = newState()
+	}
+	loadPendingLogins(session).add(state, pending, o.state_ttl)
 	err = session.Save(ctx, w)
 	if err != nil {
-		wherr.Handle(w, r, err)
+		o.loginError(w, r, err)
 		return
 	}
 
-	opts := make([]oauth2.AuthCodeOption, 0, 2)
+	opts := make([]oauth2.AuthCodeOption, 0,
+		6+len(o.provider.AuthCodeOptions))
+	opts = append(opts, o.provider.AuthCodeOptions...)
+	if pending.Verifier != "" {
+		opts = append(opts, codeChallengeOptions(pending.Verifier)...)
+	}
+	if pending.Nonce != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", pending.Nonce))
+	}
 	if o.accessOffline {
 		opts = append(opts, oauth2.AccessTypeOffline)
 	} else {
@@ -177,71 +365,258 @@ func (o *ProviderHandler) login(w http.ResponseWriter, r *http.Request) {
 	if force_prompt {
 		opts = append(opts, oauth2.ApprovalForce)
 	}
+	if o.provider.IncludeGrantedScopes {
+		opts = append(opts,
+			oauth2.SetAuthURLParam("include_granted_scopes", "true"))
+	}
 
-	whredir.Redirect(w, r, o.provider.AuthCodeURL(state, opts...))
+	whredir.Redirect(w, r, conf.AuthCodeURL(state, opts...))
 }
 
+// cb finishes a login. Providers send the callback parameters in the query
+// string, or with response_mode=form_post, in a POST body, which keeps them
+// out of URLs, browser history and logs.
 func (o *ProviderHandler) cb(w http.ResponseWriter, r *http.Request) {
+	r = withResponseWriter(r, w)
 	ctx := whcompat.Context(r)
+	if r.Method == "POST" {
+		err := r.ParseForm()
+		if err != nil {
+			o.loginError(w, r, wherr.BadRequest.Wrap(err))
+			return
+		}
+	}
 	session, err := o.Session(ctx)
 	if err != nil {
-		wherr.Handle(w, r, err)
+		o.loginError(w, r, err)
 		return
 	}
 
-	val, exists := session.Values["_state"]
-	existing_state, correct := val.(string)
-	if !exists || !correct {
-		wherr.Handle(w, r,
-			wherr.BadRequest.New("invalid session storage state"))
+	logins := loadPendingLogins(session)
+	state := r.FormValue("state")
+	if r.Method == "POST" && !logins.has(state) &&
+		r.PostForm.Get(formPostRelayed) == "" {
+		o.relayFormPost(w, r)
+		return
+	}
+	pending, err := logins.take(state, o.state_ttl)
+	if CSRFDetected.Contains(err) {
+		o.csrfFailure(w, r, err)
 		return
 	}
 
-	val, exists = session.Values["_redirect_to"]
-	redirect_to, correct := val.(string)
-	if !exists || !correct {
-		wherr.Handle(w, r,
-			wherr.BadRequest.New("invalid redirect_to"))
+	// from here on the login attempt is used up, so failures still need to
+	// save the session to remember that.
+	fail := func(err error) {
+		session.Save(ctx, w)
+		o.loginError(w, r, err)
+	}
+	if err != nil {
+		fail(err)
 		return
 	}
+	redirect_to := pending.RedirectTo
 
-	if existing_state != r.FormValue("state") {
-		wherr.Handle(w, r, wherr.BadRequest.New("csrf detected"))
+	if e := authorizationError(r); e != nil {
+		fail(e)
+		return
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		fail(wherr.BadRequest.New("missing code"))
 		return
 	}
 
-	var accessType oauth2.AuthCodeOption
+	opts := make([]oauth2.AuthCodeOption, 0, 2)
 	if o.accessOffline {
-		accessType = oauth2.AccessTypeOffline
+		opts = append(opts, oauth2.AccessTypeOffline)
 	} else {
-		accessType = oauth2.AccessTypeOnline
+		opts = append(opts, oauth2.AccessTypeOnline)
+	}
+	if !o.provider.DisablePKCE {
+		if pending.Verifier == "" {
+			fail(wherr.BadRequest.New("login started without pkce"))
+			return
+		}
+		opts = append(opts, codeVerifierOption(pending.Verifier))
 	}
 
-	token, err := o.provider.Exchange(ctx, r.FormValue("code"), accessType)
+	provider, err := o.provider.withSecret(ctx)
 	if err != nil {
-		wherr.Handle(w, r, err)
+		fail(err)
 		return
 	}
+	token, err := provider.Exchange(ctx, code, opts...)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var raw_id_token string
+	var claims *Claims
+	if o.provider.OIDC != nil {
+		claims, raw_id_token, err = o.verifyIDToken(ctx, pending, token)
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	var info *UserInfo
+	if o.provider.UserInfoFromCallback != nil {
+		info, err = o.provider.UserInfoFromCallback(r, claims)
+		if err != nil {
+			fail(err)
+			return
+		}
+	} else if o.provider.FetchUserInfo != nil {
+		info, err = o.provider.FetchUserInfo(ctx,
+			oauth2.NewClient(ctx, oauth2.StaticTokenSource(token)))
+		if err != nil {
+			// the profile is a convenience, so the login goes ahead without
+			// it unless the application says otherwise.
+			info = nil
+			if o.hooks.OnUserInfoError != nil {
+				err = o.hooks.OnUserInfoError(ctx, o.provider, err)
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}
+	}
+
+	requested := pending.Scopes
+	if requested == nil {
+		requested = o.provider.Scopes
+	}
+	scopes := grantedScopes(token, requested)
+
+	id := &Identity{
+		Provider: o.provider.Name,
+		Token:    token,
+		Scopes:   scopes,
+		Claims:   claims,
+		UserInfo: info}
+	if claims != nil {
+		id.Subject = claims.Subject
+	}
+	if id.Subject == "" && info != nil {
+		id.Subject = info.ID
+	}
+
+	// conflicts are found before the application sees the login, but
+	// nothing is linked until it has accepted it.
+	var link func(w http.ResponseWriter) error
+	if o.on_identity != nil {
+		link, err = o.on_identity(ctx, id, pending.Attach)
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
 
-	session.Values["_token"] = token
+	if o.hooks.OnLoginSuccess != nil {
+		redirect_to, err = o.hooks.OnLoginSuccess(ctx, o.provider, id,
+			redirect_to)
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	if link != nil {
+		err = link(w)
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	err = o.putToken(ctx, session, token)
+	if err != nil {
+		fail(err)
+		return
+	}
+	err = o.putLoginInfo(ctx, session, raw_id_token, info)
+	if err != nil {
+		fail(err)
+		return
+	}
+	session.Values["_scopes"] = scopes
 	err = session.Save(ctx, w)
 	if err != nil {
-		wherr.Handle(w, r, err)
+		o.loginError(w, r, err)
 		return
 	}
 
 	whredir.Redirect(w, r, redirect_to)
 }
 
+// verifyIDToken checks the ID token that came with token against the
+// provider's OIDC configuration and the nonce of the pending login.
+func (o *ProviderHandler) verifyIDToken(ctx context.Context,
+	pending *pendingLogin, token *oauth2.Token) (*Claims, string, error) {
+	raw_id_token, ok := token.Extra("id_token").(string)
+	if !ok || raw_id_token == "" {
+		return nil, "", IDTokenError.New("no id_token in token response")
+	}
+	claims, err := o.provider.OIDC.Verify(ctx, o.provider.ClientID,
+		raw_id_token)
+	if err != nil {
+		return nil, "", err
+	}
+	if pending.Nonce == "" || claims.Nonce != pending.Nonce {
+		return nil, "", IDTokenError.New("nonce mismatch")
+	}
+	return claims, raw_id_token, nil
+}
+
+// formPostRelayed marks callback POSTs that came from relayFormPost.
+const formPostRelayed = "relayed"
+
+var formPostRelayTemplate = template.Must(template.New("relay").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><meta name="referrer" content="no-referrer"><title>Logging in</title></head>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{.Action}}">
+{{range $name, $vals := .Form}}{{range $vals}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<input type="hidden" name="relayed" value="true">
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// relayFormPost answers a form_post callback that came without the session
+// cookie. Browsers don't send SameSite=Lax cookies with the provider's
+// cross-site POST, so the parameters are posted again from a page on this
+// site, which does get the cookies, without putting them in a URL.
+func (o *ProviderHandler) relayFormPost(w http.ResponseWriter,
+	r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err := formPostRelayTemplate.Execute(w, map[string]interface{}{
+		"Action": o.handler_base_url + "/_cb",
+		"Form":   r.PostForm})
+	if err != nil {
+		o.loginError(w, r, err)
+	}
+}
+
 func (o *ProviderHandler) logout(w http.ResponseWriter, r *http.Request) {
 	err := o.Logout(whcompat.Context(r), w)
 	if err != nil {
 		wherr.Handle(w, r, err)
 		return
 	}
-	redirect_to := r.FormValue("redirect_to")
-	if redirect_to == "" {
-		redirect_to = o.urls.DefaultLogoutURL
+	redirect_to := o.urls.redirectTarget(r, r.FormValue("redirect_to"),
+		o.urls.DefaultLogoutURL)
+	if o.hooks.OnLogout != nil {
+		redirect_to = o.hooks.OnLogout(whcompat.Context(r), o.provider,
+			redirect_to)
 	}
 	whredir.Redirect(w, r, redirect_to)
 }
@@ -249,13 +624,19 @@ func (o *ProviderHandler) logout(w http.ResponseWriter, r *http.Request) {
 func (o *ProviderHandler) loginRequired(h http.Handler, forcePrompt bool) http.Handler {
 	return whroute.HandlerFunc(h,
 		func(w http.ResponseWriter, r *http.Request) {
+			r = withResponseWriter(r, w)
 			token, err := o.Token(whcompat.Context(r))
 			if err != nil {
 				wherr.Handle(w, r, err)
 				return
 			}
 			if token == nil {
-				whredir.Redirect(w, r, o.LoginURL(r.RequestURI, forcePrompt))
+				login_url := o.LoginURL(r.RequestURI, forcePrompt)
+				if wantsJSON(r) {
+					loginRequiredJSON(w, login_url)
+					return
+				}
+				whredir.Redirect(w, r, login_url)
 				return
 			}
 			h.ServeHTTP(w, r)
@@ -263,16 +644,19 @@ func (o *ProviderHandler) loginRequired(h http.Handler, forcePrompt bool) http.H
 }
 
 // LoginRequired is a middleware for redirecting users to a login page if
-// they aren't logged in yet. If you are using a ProviderGroup and don't know
-// which provider a user should use, consider using
-// (*ProviderGroup).LoginRequired instead
+// they aren't logged in yet. Requests that accept application/json get a 401
+// with a JSON body containing the login URL instead. If you are using a
+// ProviderGroup and don't know which provider a user should use, consider
+// using (*ProviderGroup).LoginRequired instead.
 func (o *ProviderHandler) LoginRequired(h http.Handler) http.Handler {
 	return o.loginRequired(h, false)
 }
 
-// LoginRequiredForcePrompt is a middleware for redirecting users to a login page if
-// they aren't logged in yet. If you are using a ProviderGroup and don't know
-// which provider a user should use, consider using
+// LoginRequiredForcePrompt is a middleware for redirecting users to a login
+// page if they aren't logged in yet, forcing the provider to prompt them.
+// Requests that accept application/json get a 401 with a JSON body
+// containing the login URL instead. If you are using a ProviderGroup and
+// don't know which provider a user should use, consider using
 // (*ProviderGroup).LoginRequired instead.
 func (o *ProviderHandler) LoginRequiredForcePrompt(h http.Handler) http.Handler {
 	return o.loginRequired(h, true)
@@ -0,0 +1,1233 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spacemonkeygo/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+	"gopkg.in/webhelp.v1/whcompat"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+// testApp is an application that logs users in with a whoauth2test.Server.
+// The provider handler is mounted at /auth, and every other page says who
+// is logged in.
+type testApp struct {
+	*httptest.Server
+	idp     *whoauth2test.Server
+	handler *whoauth2.ProviderHandler
+	mux     *http.ServeMux
+
+	mtx       sync.Mutex
+	login_err error
+}
+
+func newTestApp(idp *whoauth2test.Server) *testApp {
+	return newTestAppWithURLs(idp, whoauth2.RedirectURLs{})
+}
+
+// newTestAppWithURLs is like newTestApp, with the given RedirectURLs.
+func newTestAppWithURLs(idp *whoauth2test.Server,
+	urls whoauth2.RedirectURLs) *testApp {
+	app := &testApp{idp: idp, mux: http.NewServeMux()}
+	app.Server = httptest.NewServer(whsess.HandlerWithStore(
+		whsess.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")),
+		app.mux))
+	app.handler = whoauth2.NewProviderHandler(
+		idp.Provider("test", app.URL+"/auth/_cb"), "oauth-test", "/auth",
+		urls)
+	app.handler.SetHooks(whoauth2.Hooks{OnLoginError: app.loginError})
+	app.mux.Handle("/auth/", http.StripPrefix("/auth", app.handler))
+	app.mux.Handle("/", whoauth2.SaveRefreshedTokens(http.HandlerFunc(app.page)))
+	return app
+}
+
+func (app *testApp) page(w http.ResponseWriter, r *http.Request) {
+	id, err := app.handler.Identity(whcompat.Context(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if id == nil {
+		fmt.Fprint(w, "logged out")
+		return
+	}
+	fmt.Fprintf(w, "logged in as %s", id.Subject)
+}
+
+func (app *testApp) loginError(w http.ResponseWriter, r *http.Request,
+	provider *whoauth2.Provider, err error) {
+	app.mtx.Lock()
+	app.login_err = err
+	app.mtx.Unlock()
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// lastLoginError returns the error of the most recent failed login and
+// forgets it.
+func (app *testApp) lastLoginError() error {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	err := app.login_err
+	app.login_err = nil
+	return err
+}
+
+// get fetches path on the app as user and returns the final body.
+func (app *testApp) get(user *whoauth2test.User, path string) (
+	string, int, error) {
+	return fetch(user.Client, app.URL+path)
+}
+
+// startLogin starts a login as user and returns the URL of the provider's
+// authorization endpoint it redirects to, without following it.
+func (app *testApp) startLogin(user *whoauth2test.User) (*url.URL, error) {
+	return app.redirect(user, app.handler.LoginURL("/", false))
+}
+
+// redirect fetches path on the app as user and returns where it redirects
+// to, without following it.
+func (app *testApp) redirect(user *whoauth2test.User, path string) (
+	*url.URL, error) {
+	client := &http.Client{
+		Jar: user.Jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	resp, err := client.Get(app.URL + path)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 3 {
+		return nil, fmt.Errorf("%s didn't redirect: %s", path, resp.Status)
+	}
+	return resp.Location()
+}
+
+func fetch(client *http.Client, url string) (string, int, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), resp.StatusCode, err
+}
+
+func TestLogin(t *testing.T) {
+	idp := whoauth2test.NewServer(
+		whoauth2test.Identity{Subject: "alice"},
+		whoauth2test.Identity{Subject: "bob"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+
+	user := idp.User("bob")
+	body, _, err := app.get(user, "/")
+	if err != nil || body != "logged out" {
+		t.Fatalf("got %#v, %v before login", body, err)
+	}
+	resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	body, _, err = app.get(user, "/")
+	if err != nil || body != "logged in as bob" {
+		t.Fatalf("got %#v, %v after login", body, err)
+	}
+}
+
+func TestLoginNonceMismatch(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+
+	user := idp.User("")
+	authorize_url, err := app.startLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := authorize_url.Query()
+	if q.Get("nonce") == "" {
+		t.Fatalf("no nonce in %s", authorize_url)
+	}
+	q.Set("nonce", "replayed-nonce")
+	authorize_url.RawQuery = q.Encode()
+
+	_, status, err := fetch(user.Client, authorize_url.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == http.StatusOK {
+		t.Fatalf("login with the wrong nonce succeeded")
+	}
+	if err := app.lastLoginError(); !whoauth2.IDTokenError.Contains(err) {
+		t.Fatalf("expected an IDTokenError, got %v", err)
+	}
+	body, _, err := app.get(user, "/")
+	if err != nil || body != "logged out" {
+		t.Fatalf("got %#v, %v after failed login", body, err)
+	}
+}
+
+func TestLoginPKCE(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+
+	user := idp.User("")
+	authorize_url, err := app.startLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := authorize_url.Query()
+	if q.Get("code_challenge") == "" ||
+		q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("no S256 code challenge in %s", authorize_url)
+	}
+	// a code that was issued for another challenge, as an attacker who
+	// intercepted it would have, can't be exchanged with this verifier.
+	q.Set("code_challenge", "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+	authorize_url.RawQuery = q.Encode()
+
+	_, status, err := fetch(user.Client, authorize_url.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == http.StatusOK {
+		t.Fatalf("login with the wrong code challenge succeeded")
+	}
+	if err := app.lastLoginError(); err == nil {
+		t.Fatalf("expected a login error")
+	}
+	body, _, err := app.get(user, "/")
+	if err != nil || body != "logged out" {
+		t.Fatalf("got %#v, %v after failed login", body, err)
+	}
+}
+
+func TestLoginDisablePKCE(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	app.handler.Provider().DisablePKCE = true
+
+	user := idp.User("")
+	authorize_url, err := app.startLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorize_url.Query().Get("code_challenge") != "" {
+		t.Fatalf("code challenge sent with PKCE disabled: %s", authorize_url)
+	}
+	_, _, err = fetch(user.Client, authorize_url.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := app.get(user, "/")
+	if err != nil || body != "logged in as alice" {
+		t.Fatalf("got %#v, %v after login", body, err)
+	}
+}
+
+// loginCallback logs in as user and returns the callback URL the provider
+// sent the user to.
+func (app *testApp) loginCallback(user *whoauth2test.User) (string, error) {
+	var callback string
+	client := &http.Client{
+		Jar: user.Jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.Path, "/auth/_cb") {
+				callback = req.URL.String()
+			}
+			return nil
+		}}
+	_, status, err := fetch(client, app.URL+app.handler.LoginURL("/", false))
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK || callback == "" {
+		return "", fmt.Errorf("login failed with status %d", status)
+	}
+	return callback, nil
+}
+
+func TestLoginState(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+
+	for _, test := range []struct {
+		name string
+		// callback returns the callback URL to visit after a login as user
+		// was started or finished.
+		callback func(app *testApp, user *whoauth2test.User) (string, error)
+		class    *errors.ErrorClass
+	}{
+		{"replayed",
+			func(app *testApp, user *whoauth2test.User) (string, error) {
+				return app.loginCallback(user)
+			},
+			whoauth2.StateReused},
+		{"replayed by another user",
+			func(app *testApp, user *whoauth2test.User) (string, error) {
+				return app.loginCallback(idp.User(""))
+			},
+			whoauth2.CSRFDetected},
+		{"expired",
+			func(app *testApp, user *whoauth2test.User) (string, error) {
+				app.handler.SetStateTTL(50 * time.Millisecond)
+				authorize_url, err := app.startLogin(user)
+				if err != nil {
+					return "", err
+				}
+				time.Sleep(100 * time.Millisecond)
+				return authorize_url.String(), nil
+			},
+			whoauth2.StateExpired},
+		{"forged",
+			func(app *testApp, user *whoauth2test.User) (string, error) {
+				_, err := app.startLogin(user)
+				return app.URL + "/auth/_cb?code=forged&state=forged", err
+			},
+			whoauth2.CSRFDetected},
+	} {
+		app := newTestApp(idp)
+		user := idp.User("")
+		callback, err := test.callback(app, user)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			app.Close()
+			continue
+		}
+		app.lastLoginError()
+		_, status, err := fetch(user.Client, callback)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if status == http.StatusOK {
+			t.Errorf("%s: callback succeeded", test.name)
+		} else if err := app.lastLoginError(); !test.class.Contains(err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		app.Close()
+	}
+}
+
+func TestLoginTwoTabs(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+
+	for _, reversed := range []bool{false, true} {
+		app := newTestApp(idp)
+		user := idp.User("")
+		// both tabs start a login before either comes back.
+		var callbacks []string
+		for i := 0; i < 2; i++ {
+			callback, err := app.callback(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			callbacks = append(callbacks, callback.String())
+		}
+		if reversed {
+			callbacks[0], callbacks[1] = callbacks[1], callbacks[0]
+		}
+		for i, callback := range callbacks {
+			body, status, err := fetch(user.Client, callback)
+			if err != nil || status != http.StatusOK ||
+				body != "logged in as alice" {
+				t.Errorf("reversed %v: callback %d got %d %#v, %v: %v",
+					reversed, i, status, body, err, app.lastLoginError())
+			}
+		}
+		app.Close()
+	}
+}
+
+func TestTokenEncryptionRotation(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+
+	key := func(b byte) []byte {
+		return []byte(strings.Repeat(string(rune('a'+b)), 32))
+	}
+	ring := func(primary []byte, old ...[]byte) *whoauth2.KeyRing {
+		k, err := whoauth2.NewKeyRing(primary, old...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	app.handler.SetTokenEncryption(ring(key(1)))
+	user := idp.User("")
+	resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, step := range []struct {
+		name string
+		ring *whoauth2.KeyRing
+		body string
+	}{
+		{"rotated", ring(key(2), key(1)), "logged in as alice"},
+		// reading the token above sealed it again with the primary key.
+		{"old key removed", ring(key(2)), "logged in as alice"},
+		// tokens nobody can decrypt anymore count as logged out.
+		{"key lost", ring(key(3)), "logged out"},
+	} {
+		app.handler.SetTokenEncryption(step.ring)
+		body, status, err := app.get(user, "/")
+		if err != nil || status != http.StatusOK || body != step.body {
+			t.Fatalf("%s: got %d %#v, %v", step.name, status, body, err)
+		}
+	}
+
+	// logging out works without a readable token.
+	app.handler.SetTokenEncryption(ring(key(1)))
+	resp, err = user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	app.handler.SetTokenEncryption(ring(key(3)))
+	_, status, err := app.get(user, app.handler.LogoutURL("/"))
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("logout: got %d, %v", status, err)
+	}
+}
+
+func TestLoginUserInfoError(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+
+	for _, reject := range []bool{false, true} {
+		app := newTestApp(idp)
+		app.handler.Provider().FetchUserInfo = whoauth2.OIDCUserInfo(
+			idp.URL + "/missing")
+		var fetch_err error
+		app.handler.SetHooks(whoauth2.Hooks{
+			OnLoginError: app.loginError,
+			OnUserInfoError: func(ctx context.Context,
+				provider *whoauth2.Provider, err error) error {
+				fetch_err = err
+				if reject {
+					return err
+				}
+				return nil
+			}})
+
+		user := idp.User("")
+		_, _, err := fetch(user.Client,
+			app.URL+app.handler.LoginURL("/", false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetch_err == nil {
+			t.Errorf("reject %v: OnUserInfoError wasn't called", reject)
+		}
+		want := "logged in as alice"
+		if reject {
+			want = "logged out"
+		}
+		body, _, err := app.get(user, "/")
+		if err != nil || body != want {
+			t.Errorf("reject %v: got %#v, %v", reject, body, err)
+		}
+		app.Close()
+	}
+}
+
+func TestTokenRefreshFailed(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+
+	// only invalid_grant means the refresh token is no good, so the user
+	// stays logged in through other failures.
+	for _, error_code := range []string{"invalid_client",
+		"temporarily_unavailable", "slow_down"} {
+		user := idp.User("")
+		app := newRefreshingApp(t, idp, user)
+		idp.SetTokenError(error_code)
+		_, status, err := app.get(user, "/saved")
+		if err != nil || status != http.StatusInternalServerError {
+			t.Errorf("%s: got %d, %v", error_code, status, err)
+		}
+		idp.SetTokenError("")
+		body, _, err := app.get(user, "/saved")
+		if err != nil || !idp.Active(body) {
+			t.Errorf("%s: after the error got %#v, %v", error_code, body, err)
+		}
+		app.Close()
+	}
+}
+
+// accessToken writes the user's access token, or "logged out".
+func (app *testApp) accessToken(w http.ResponseWriter, r *http.Request) {
+	token, err := app.handler.Token(whcompat.Context(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		fmt.Fprint(w, "logged out")
+		return
+	}
+	fmt.Fprint(w, token.AccessToken)
+}
+
+// newRefreshingApp makes a testApp with offline tokens that are refreshed
+// on every use, and logs user in. The access token is at /saved, which can
+// save refreshed tokens, and /unsaved, which can't.
+func newRefreshingApp(t *testing.T, idp *whoauth2test.Server,
+	user *whoauth2test.User) *testApp {
+	// shorter than the oauth2 package's expiry slack, so every use of the
+	// token refreshes it.
+	idp.SetTokenLifetime(time.Second)
+	app := newTestApp(idp)
+	app.handler.RequestOfflineTokens()
+	app.mux.Handle("/saved",
+		whoauth2.SaveRefreshedTokens(http.HandlerFunc(app.accessToken)))
+	app.mux.HandleFunc("/unsaved", app.accessToken)
+
+	resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		app.Close()
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return app
+}
+
+func TestTokenRefresh(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	user := idp.User("")
+	app := newRefreshingApp(t, idp, user)
+	defer app.Close()
+
+	// refresh tokens are rotated, so each refresh only works if the one
+	// before it was saved.
+	last := ""
+	for i := 0; i < 3; i++ {
+		body, status, err := app.get(user, "/saved")
+		if err != nil || status != http.StatusOK || body == "logged out" ||
+			body == last || !idp.Active(body) {
+			t.Fatalf("refresh %d: got %d %#v, %v", i, status, body, err)
+		}
+		last = body
+	}
+
+	// without a way to save the refreshed token, the expired one counts as
+	// logged out and is left alone.
+	refreshes := idp.Refreshes()
+	body, status, err := app.get(user, "/unsaved")
+	if err != nil || status != http.StatusOK || body != "logged out" {
+		t.Fatalf("unsaved: got %d %#v, %v", status, body, err)
+	}
+	if idp.Refreshes() != refreshes {
+		t.Fatalf("unsaved: refreshed the token")
+	}
+	body, _, err = app.get(user, "/saved")
+	if err != nil || body == "logged out" || !idp.Active(body) {
+		t.Fatalf("after unsaved: got %#v, %v", body, err)
+	}
+}
+
+func TestTokenRefreshConcurrent(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	user := idp.User("")
+	app := newRefreshingApp(t, idp, user)
+	defer app.Close()
+
+	app_url, err := url.Parse(app.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every request shows up with the same expired token, like parallel
+	// requests from one browser do.
+	cookies := user.Jar.Cookies(app_url)
+	refreshes := idp.Refreshes()
+
+	const requests = 10
+	bodies := make([]string, requests)
+	errs := make([]error, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", app.URL+"/saved", nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			bodies[i], errs[i] = string(body), err
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range bodies {
+		if errs[i] != nil || bodies[i] != bodies[0] {
+			t.Fatalf("request %d: got %#v, %v, request 0 got %#v", i,
+				bodies[i], errs[i], bodies[0])
+		}
+	}
+	if !idp.Active(bodies[0]) {
+		t.Fatalf("got inactive token %#v", bodies[0])
+	}
+	if got := idp.Refreshes() - refreshes; got != 1 {
+		t.Fatalf("got %d refresh grants", got)
+	}
+}
+
+func TestTokenRefreshRejected(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	user := idp.User("")
+	app := newRefreshingApp(t, idp, user)
+	defer app.Close()
+
+	idp.SetTokenError("invalid_grant")
+	refreshes := idp.Refreshes()
+	for i := 0; i < 3; i++ {
+		body, status, err := app.get(user, "/saved")
+		if err != nil || status != http.StatusOK || body != "logged out" {
+			t.Fatalf("request %d: got %d %#v, %v", i, status, body, err)
+		}
+	}
+	// the rejected token is dropped rather than tried on every request.
+	if got := idp.Refreshes() - refreshes; got != 1 {
+		t.Fatalf("got %d refresh grants", got)
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	app.handler.Provider().IncludeGrantedScopes = true
+	app.mux.Handle("/calendar", app.handler.RequireScopes(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "calendar")
+		}), "calendar"))
+
+	user := idp.User("")
+	resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the incremental login asks for the granted scopes plus the new one.
+	login_url, err := app.redirect(user, "/calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize_url, err := app.redirect(user, login_url.RequestURI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := authorize_url.Query()
+	if got := q.Get("scope"); got != "openid email profile calendar" {
+		t.Fatalf("got scope %#v", got)
+	}
+	if got := q.Get("include_granted_scopes"); got != "true" {
+		t.Fatalf("got include_granted_scopes %#v", got)
+	}
+
+	body, _, err := app.get(user, "/calendar")
+	if err != nil || body != "calendar" {
+		t.Fatalf("got %#v, %v", body, err)
+	}
+	// granted scopes are remembered.
+	if _, err := app.redirect(user, "/calendar"); err == nil {
+		t.Fatalf("asked for the calendar scope again")
+	}
+}
+
+func TestRequireScopesRenamed(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	app.mux.Handle("/email", app.handler.RequireScopes(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "email")
+		}), "email"))
+	// like Google, the provider answers with the full names of the scopes.
+	idp.SetScopes("openid", "https://www.googleapis.com/auth/userinfo.email",
+		"https://www.googleapis.com/auth/userinfo.profile")
+
+	user := idp.User("")
+	body, status, err := app.get(user, "/email")
+	if err != nil || status != http.StatusOK || body != "email" {
+		t.Fatalf("got %d %#v, %v", status, body, err)
+	}
+	if _, err := app.redirect(user, "/email"); err == nil {
+		t.Fatalf("asked for the email scope again")
+	}
+}
+
+func TestLoginScopeNotAllowed(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	app.handler.RequireScopes(http.NotFoundHandler(), "calendar")
+
+	user := idp.User("")
+	for _, scope := range []string{"admin", "calendar admin", "email admin"} {
+		_, status, err := app.get(user, "/auth/login?"+url.Values{
+			"redirect_to": {"/"}, "scope": {scope}}.Encode())
+		if err != nil || status != http.StatusBadRequest {
+			t.Fatalf("%s: got %d, %v", scope, status, err)
+		}
+		if err := app.lastLoginError(); !whoauth2.ScopeNotAllowed.Contains(
+			err) {
+			t.Fatalf("%s: got %v", scope, err)
+		}
+	}
+	authorize_url, err := app.redirect(user, "/auth/login?"+url.Values{
+		"redirect_to": {"/"}, "scope": {"calendar"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := authorize_url.Query().Get("scope"); got !=
+		"openid email profile calendar" {
+		t.Fatalf("got scope %#v", got)
+	}
+}
+
+// relayInput matches the hidden inputs of the page that relays form_post
+// callbacks.
+var relayInput = regexp.MustCompile(
+	`<input type="hidden" name="([^"]*)" value="([^"]*)">`)
+
+func TestLoginFormPost(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	app.handler.Provider().UserInfoFromCallback = whoauth2.AppleUserInfo
+	app.mux.HandleFunc("/name", func(w http.ResponseWriter, r *http.Request) {
+		info, err := app.handler.UserInfo(whcompat.Context(r))
+		if err != nil || info == nil {
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, info.Name)
+	})
+	no_redirects := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	for _, relay := range []bool{false, true} {
+		user := idp.User("")
+		authorize_url, err := app.startLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{CheckRedirect: no_redirects}).Get(
+			authorize_url.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		callback, err := resp.Location()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// what a form_post provider posts instead of redirecting.
+		form := callback.Query()
+		form.Set("user",
+			`{"name": {"firstName": "Alice", "lastName": "Smith"}}`)
+
+		client := &http.Client{Jar: user.Jar, CheckRedirect: no_redirects}
+		if relay {
+			// browsers leave SameSite=Lax session cookies off cross-site
+			// POSTs, so the callback has to relay the form to itself.
+			resp, err := (&http.Client{CheckRedirect: no_redirects}).PostForm(
+				app.URL+"/auth/_cb", form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("relay: got %s, %v", resp.Status, err)
+			}
+			form = url.Values{}
+			for _, input := range relayInput.FindAllStringSubmatch(
+				string(body), -1) {
+				form.Add(html.UnescapeString(input[1]),
+					html.UnescapeString(input[2]))
+			}
+			if form.Get("code") == "" || form.Get("relayed") == "" {
+				t.Fatalf("relay: got form %v from %s", form, body)
+			}
+		}
+		resp, err = client.PostForm(app.URL+"/auth/_cb", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 3 ||
+			resp.Header.Get("Location") != "/" {
+			t.Fatalf("relay %v: got %s to %#v", relay, resp.Status,
+				resp.Header.Get("Location"))
+		}
+
+		body, _, err := app.get(user, "/name")
+		if err != nil || body != "Alice Smith" {
+			t.Fatalf("relay %v: got %#v, %v", relay, body, err)
+		}
+	}
+}
+
+// mapStore is a TokenStore that lets tests see what is stored.
+type mapStore struct {
+	mtx  sync.Mutex
+	data map[string][]byte
+}
+
+func (s *mapStore) Get(ctx context.Context, id string) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.data[id], nil
+}
+
+func (s *mapStore) Put(ctx context.Context, id string, data []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.data == nil {
+		s.data = make(map[string][]byte)
+	}
+	s.data[id] = data
+	return nil
+}
+
+func (s *mapStore) Delete(ctx context.Context, id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.data, id)
+	return nil
+}
+
+func (s *mapStore) len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.data)
+}
+
+func (s *mapStore) clear() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.data = nil
+}
+
+// sessionCookie returns the size of user's session cookie for app.
+func (app *testApp) sessionCookie(t *testing.T, user *whoauth2test.User) int {
+	u, err := url.Parse(app.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range user.Jar.Cookies(u) {
+		if cookie.Name == "oauth-test" {
+			return len(cookie.Value)
+		}
+	}
+	t.Fatalf("no session cookie")
+	return 0
+}
+
+func TestTokenStore(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+
+	login := func(app *testApp) *whoauth2test.User {
+		user := idp.User("")
+		resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		body, _, err := app.get(user, "/")
+		if err != nil || body != "logged in as alice" {
+			t.Fatalf("got %#v, %v after login", body, err)
+		}
+		return user
+	}
+
+	app := newTestApp(idp)
+	without_store := app.sessionCookie(t, login(app))
+	app.Close()
+
+	for _, encrypt := range []bool{false, true} {
+		app := newTestApp(idp)
+		store := &mapStore{}
+		app.handler.SetTokenStore(store)
+		if encrypt {
+			keys, err := whoauth2.NewKeyRing(
+				[]byte("0123456789abcdef0123456789abcdef"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.handler.SetTokenEncryption(keys)
+		}
+
+		// the token, the ID token and the user info all go to the store,
+		// which leaves the session with little more than a reference.
+		user := login(app)
+		if store.len() != 2 {
+			t.Fatalf("encrypt %v: got %d stored entries", encrypt,
+				store.len())
+		}
+		if size := app.sessionCookie(t, user); size > without_store/2 {
+			t.Fatalf("encrypt %v: got a %d byte session cookie, %d without "+
+				"a store", encrypt, size, without_store)
+		}
+
+		// logging out removes everything from the store.
+		_, _, err := app.get(user, app.handler.LogoutURL("/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store.len() != 0 {
+			t.Fatalf("encrypt %v: got %d stored entries after logout",
+				encrypt, store.len())
+		}
+
+		// sessions whose token is gone from the store are logged out.
+		user = login(app)
+		store.clear()
+		body, _, err := app.get(user, "/")
+		if err != nil || body != "logged out" {
+			t.Fatalf("encrypt %v: got %#v, %v", encrypt, body, err)
+		}
+		app.Close()
+	}
+}
+
+// callback starts a login as user and returns the URL the provider sends
+// the user back to, without following it.
+func (app *testApp) callback(user *whoauth2test.User) (*url.URL, error) {
+	authorize_url, err := app.startLogin(user)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}).Get(authorize_url.String())
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Location()
+}
+
+func TestLoginCallbackErrors(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+
+	for _, test := range []struct {
+		name            string
+		authorize_error string
+		token_error     string
+		login_error_url string
+		hook            bool
+		json            bool
+		status          int
+		location        string
+		error_code      string
+	}{
+		{name: "denied", authorize_error: whoauth2.ErrorAccessDenied,
+			status: http.StatusForbidden},
+		{name: "denied hook", authorize_error: whoauth2.ErrorAccessDenied,
+			login_error_url: "/login-error", hook: true,
+			status: http.StatusBadRequest},
+		{name: "denied redirect", authorize_error: whoauth2.ErrorAccessDenied,
+			login_error_url: "/login-error?from=test",
+			status:          http.StatusSeeOther,
+			location:        "/login-error?from=test&error=access_denied"},
+		{name: "denied json", authorize_error: whoauth2.ErrorAccessDenied,
+			login_error_url: "/login-error", json: true,
+			status: http.StatusForbidden, error_code: "access_denied"},
+		{name: "unavailable", authorize_error: "temporarily_unavailable",
+			status: http.StatusServiceUnavailable},
+		// failures at the token endpoint aren't the user's doing, so they
+		// don't go to LoginErrorURL.
+		{name: "token error", token_error: "invalid_grant",
+			login_error_url: "/login-error",
+			status:          http.StatusInternalServerError},
+		{name: "token error hook", token_error: "invalid_grant", hook: true,
+			status: http.StatusBadRequest},
+		{name: "token error json", token_error: "invalid_grant", json: true,
+			status:     http.StatusInternalServerError,
+			error_code: whoauth2.ErrorServerError},
+	} {
+		app := newTestAppWithURLs(idp, whoauth2.RedirectURLs{
+			LoginErrorURL: test.login_error_url})
+		if !test.hook {
+			app.handler.SetHooks(whoauth2.Hooks{})
+		}
+		idp.SetAuthorizeError(test.authorize_error)
+		idp.SetTokenError(test.token_error)
+
+		user := idp.User("")
+		callback, err := app.callback(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("GET", callback.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.json {
+			req.Header.Set("Accept", "application/json")
+		}
+		resp, err := (&http.Client{Jar: user.Jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			}}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status ||
+			resp.Header.Get("Location") != test.location {
+			t.Errorf("%s: got %s to %#v: %s", test.name, resp.Status,
+				resp.Header.Get("Location"), body)
+		}
+		if test.error_code != "" && !strings.Contains(string(body),
+			fmt.Sprintf(`"error":%q`, test.error_code)) {
+			t.Errorf("%s: got %s", test.name, body)
+		}
+
+		err = app.lastLoginError()
+		if test.hook {
+			switch err := err.(type) {
+			case *whoauth2.AuthorizationError:
+				if err.Code != test.authorize_error {
+					t.Errorf("%s: got %v", test.name, err)
+				}
+			case *oauth2.RetrieveError:
+				if test.token_error == "" {
+					t.Errorf("%s: got %v", test.name, err)
+				}
+			default:
+				t.Errorf("%s: got %v", test.name, err)
+			}
+		}
+
+		// nobody got logged in, and the next login works.
+		idp.SetAuthorizeError("")
+		idp.SetTokenError("")
+		page, _, err := app.get(user, "/")
+		if err != nil || page != "logged out" {
+			t.Errorf("%s: got %#v, %v", test.name, page, err)
+		}
+		resp, err = user.Login(app.URL + app.handler.LoginURL("/", false))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		resp.Body.Close()
+		app.Close()
+	}
+}
+
+func TestLogoutRevocation(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+
+	for _, test := range []struct {
+		name   string
+		strict bool
+		fail   bool
+	}{
+		{"best effort", false, false},
+		{"best effort failure", false, true},
+		{"strict", true, false},
+		{"strict failure", true, true},
+	} {
+		app := newTestApp(idp)
+		app.mux.HandleFunc("/token", app.accessToken)
+		var reported error
+		if test.strict {
+			app.handler.SetRevocationPolicy(whoauth2.StrictRevocation)
+		} else {
+			app.handler.SetRevocationPolicy(whoauth2.BestEffortRevocation(
+				func(ctx context.Context, provider *whoauth2.Provider,
+					err error) {
+					reported = err
+				}))
+		}
+		if test.fail {
+			app.handler.Provider().Revoke = whoauth2.RFC7009Revoker(
+				idp.URL + "/missing")
+		}
+
+		user := idp.User("")
+		resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		token, _, err := app.get(user, "/token")
+		if err != nil || !idp.Active(token) {
+			t.Fatalf("%s: got token %#v, %v", test.name, token, err)
+		}
+
+		body, status, err := app.get(user, app.handler.LogoutURL("/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.strict && test.fail {
+			// the logout fails and the user stays logged in, so they can try
+			// again.
+			if status != http.StatusInternalServerError {
+				t.Errorf("%s: got %d %#v", test.name, status, body)
+			}
+			body, _, err = app.get(user, "/")
+			if err != nil || body != "logged in as alice" {
+				t.Errorf("%s: got %#v, %v", test.name, body, err)
+			}
+		} else if status != http.StatusOK || body != "logged out" {
+			t.Errorf("%s: got %d %#v", test.name, status, body)
+		}
+		if idp.Active(token) != test.fail {
+			t.Errorf("%s: token active: %v", test.name, idp.Active(token))
+		}
+		if (reported != nil) != (test.fail && !test.strict) {
+			t.Errorf("%s: reported %v", test.name, reported)
+		}
+		app.Close()
+	}
+}
+
+func TestLogoutAllRevocation(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		strict bool
+		fail   bool
+	}{
+		{"best effort", false, false},
+		{"best effort failure", false, true},
+		{"strict", true, false},
+		{"strict failure", true, true},
+	} {
+		app := newGroupApp(t)
+		app.group.SetIdentityStore(nil)
+		tokens := make(map[string]string)
+		app.mux.HandleFunc("/tokens",
+			func(w http.ResponseWriter, r *http.Request) {
+				current, err := app.group.Tokens(whcompat.Context(r))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				var names []string
+				app.mtx.Lock()
+				for name, token := range current {
+					names = append(names, name)
+					tokens[name] = token.AccessToken
+				}
+				app.mtx.Unlock()
+				sort.Strings(names)
+				fmt.Fprint(w, strings.Join(names, " "))
+			})
+		if test.strict {
+			app.group.SetRevocationPolicy(whoauth2.StrictRevocation)
+		} else {
+			app.group.SetRevocationPolicy(whoauth2.BestEffortRevocation(nil))
+		}
+		if test.fail {
+			handler, _ := app.group.Handler("b")
+			handler.Provider().Revoke = whoauth2.RFC7009Revoker(
+				app.idps["b"].URL + "/missing")
+		}
+
+		user := app.user()
+		for _, provider := range []string{"a", "b"} {
+			if _, err := app.login(t, user, provider, "alice"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		body, _, err := fetch(user.Client, app.URL+"/tokens")
+		if err != nil || body != "a b" {
+			t.Fatalf("%s: got %#v, %v", test.name, body, err)
+		}
+
+		_, status, err := fetch(user.Client,
+			app.URL+app.group.LogoutAllURL("/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if test.strict && test.fail {
+			// nothing is cleared, so the user can try again.
+			want = "a b"
+			if status != http.StatusInternalServerError {
+				t.Errorf("%s: got %d", test.name, status)
+			}
+		} else if status != http.StatusOK {
+			t.Errorf("%s: got %d", test.name, status)
+		}
+		body, _, err = fetch(user.Client, app.URL+"/tokens")
+		if err != nil || body != want {
+			t.Errorf("%s: after logout got %#v, %v", test.name, body, err)
+		}
+		// the other provider's token is revoked either way.
+		app.mtx.Lock()
+		if app.idps["a"].Active(tokens["a"]) ||
+			app.idps["b"].Active(tokens["b"]) != test.fail {
+			t.Errorf("%s: a active %v, b active %v", test.name,
+				app.idps["a"].Active(tokens["a"]),
+				app.idps["b"].Active(tokens["b"]))
+		}
+		app.mtx.Unlock()
+		app.Close()
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+	"gopkg.in/webhelp.v1/wherr"
+)
+
+var (
+	// CSRFDetected is the error class for callbacks whose state doesn't match
+	// the login that was started in the session.
+	CSRFDetected = wherr.BadRequest.NewClass("csrf detected")
+)
+
+// Hooks lets an application take part in the login and logout flows, for
+// instance to provision users, write audit logs or render friendlier error
+// pages. Any of the callbacks may be nil.
+type Hooks struct {
+	// OnLoginSuccess is called once the callback has a verified token, right
+	// before it is saved to the session. id has the token along with the
+	// user's subject, ID token claims and profile, which is the only chance
+	// to see what some providers send just once, such as the user's name
+	// from Apple. It returns where to send the user, normally redirect_to.
+	// Returning an error rejects the login, and the error is handled like any
+	// other login error.
+	OnLoginSuccess func(ctx context.Context, provider *Provider,
+		id *Identity, redirect_to string) (string, error)
+
+	// OnUserInfoError is called when the provider's FetchUserInfo fails
+	// during login. Returning nil lets the login go ahead without a profile,
+	// and returning an error rejects the login like any other login error. If
+	// nil, failures are ignored.
+	OnUserInfoError func(ctx context.Context, provider *Provider,
+		err error) error
+
+	// OnLoginError writes the response for a failed login. err is an
+	// *AuthorizationError if the provider turned the login down. If nil,
+	// users are sent to RedirectURLs.LoginErrorURL for provider errors when
+	// it is set, and errors go to wherr.Handle otherwise.
+	OnLoginError func(w http.ResponseWriter, r *http.Request,
+		provider *Provider, err error)
+
+	// OnCSRFFailure writes the response when a callback's state doesn't match
+	// the session. If nil, OnLoginError is used.
+	OnCSRFFailure func(w http.ResponseWriter, r *http.Request,
+		provider *Provider, err error)
+
+	// OnLogout is called after the user logs out through a logout URL and
+	// returns where to send the user, normally redirect_to. provider is nil
+	// when logging out of every provider in a ProviderGroup.
+	OnLogout func(ctx context.Context, provider *Provider,
+		redirect_to string) string
+}
+
+// SetHooks sets the callbacks used during login and logout.
+func (o *ProviderHandler) SetHooks(hooks Hooks) {
+	o.hooks = hooks
+}
+
+// SetHooks sets the callbacks used during login and logout for the group and
+// every provider's handler.
+func (g *ProviderGroup) SetHooks(hooks Hooks) {
+	g.hooks = hooks
+	for _, handler := range g.handlers {
+		handler.SetHooks(hooks)
+	}
+}
+
+func (o *ProviderHandler) loginError(w http.ResponseWriter, r *http.Request,
+	err error) {
+	if o.hooks.OnLoginError != nil {
+		o.hooks.OnLoginError(w, r, o.provider, err)
+		return
+	}
+	o.urls.handleLoginError(w, r, err)
+}
+
+func (o *ProviderHandler) csrfFailure(w http.ResponseWriter, r *http.Request,
+	err error) {
+	if o.hooks.OnCSRFFailure != nil {
+		o.hooks.OnCSRFFailure(w, r, o.provider, err)
+		return
+	}
+	o.loginError(w, r, err)
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+)
+
+func TestOnLoginSuccess(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+
+	for _, reject := range []bool{false, true} {
+		app := newTestApp(idp)
+		var got string
+		app.handler.SetHooks(whoauth2.Hooks{
+			OnLoginError: app.loginError,
+			OnLoginSuccess: func(ctx context.Context,
+				provider *whoauth2.Provider, id *whoauth2.Identity,
+				redirect_to string) (string, error) {
+				got = provider.Name + " " + id.Subject + " " + redirect_to
+				if reject {
+					return "", errors.New("rejected")
+				}
+				return "/welcome", nil
+			}})
+
+		user := idp.User("")
+		callback, err := app.callback(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		location, err := app.redirect(user, callback.RequestURI())
+		if got != "test alice /" {
+			t.Errorf("reject %v: hook got %#v", reject, got)
+		}
+		if reject {
+			// the login fails like any other, and nobody is logged in.
+			if err == nil || app.lastLoginError() == nil {
+				t.Errorf("reject %v: got %v, %v", reject, location, err)
+			}
+			body, _, err := app.get(user, "/")
+			if err != nil || body != "logged out" {
+				t.Errorf("reject %v: got %#v, %v", reject, body, err)
+			}
+		} else if err != nil || location.Path != "/welcome" {
+			t.Errorf("reject %v: got %v, %v", reject, location, err)
+		}
+		app.Close()
+	}
+}
+
+func TestOnCSRFFailure(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+
+	var csrf_err error
+	app.handler.SetHooks(whoauth2.Hooks{
+		OnLoginError: app.loginError,
+		OnCSRFFailure: func(w http.ResponseWriter, r *http.Request,
+			provider *whoauth2.Provider, err error) {
+			csrf_err = err
+			http.Error(w, "forged", http.StatusTeapot)
+		}})
+
+	user := idp.User("")
+	if _, err := app.startLogin(user); err != nil {
+		t.Fatal(err)
+	}
+	body, status, err := app.get(user, "/auth/_cb?code=forged&state=forged")
+	if err != nil || status != http.StatusTeapot {
+		t.Fatalf("got %d %#v, %v", status, body, err)
+	}
+	if !whoauth2.CSRFDetected.Contains(csrf_err) {
+		t.Fatalf("hook got %v", csrf_err)
+	}
+	if err := app.lastLoginError(); err != nil {
+		t.Fatalf("OnLoginError got %v too", err)
+	}
+}
+
+func TestOnLogout(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+
+	var got string
+	app.handler.SetHooks(whoauth2.Hooks{
+		OnLogout: func(ctx context.Context, provider *whoauth2.Provider,
+			redirect_to string) string {
+			got = provider.Name + " " + redirect_to
+			return "/goodbye"
+		}})
+
+	user := idp.User("")
+	resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := app.redirect(user, app.handler.LogoutURL("/next"))
+	if err != nil || location.Path != "/goodbye" || got != "test /next" {
+		t.Fatalf("got %v, %v, hook got %#v", location, err, got)
+	}
+	body, _, err := app.get(user, "/")
+	if err != nil || body != "logged out" {
+		t.Fatalf("got %#v, %v", body, err)
+	}
+}
+
+func TestGroupOnLogout(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+
+	var got []string
+	app.group.SetHooks(whoauth2.Hooks{
+		OnLogout: func(ctx context.Context, provider *whoauth2.Provider,
+			redirect_to string) string {
+			name := "all"
+			if provider != nil {
+				name = provider.Name
+			}
+			got = append(got, name+" "+redirect_to)
+			return "/goodbye/" + name
+		}})
+
+	user := app.user()
+	if _, err := app.login(t, user, "a", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: user.Jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	for _, test := range []struct {
+		logout_url string
+		want       string
+	}{
+		{app.group.LogoutURL("b", "/next"), "/goodbye/b"},
+		{app.group.LogoutAllURL("/next"), "/goodbye/all"},
+	} {
+		resp, err := client.Get(app.URL + test.logout_url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != test.want {
+			t.Errorf("%s: got %s to %#v", test.logout_url, resp.Status,
+				location)
+		}
+	}
+	if len(got) != 2 || got[0] != "b /next" || got[1] != "all /next" {
+		t.Fatalf("hook got %#v", got)
+	}
+	account, _, err := fetch(user.Client, app.URL+"/")
+	if err != nil || account != `account ""` {
+		t.Fatalf("got %s, %v", account, err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// Identity describes who a request is authenticated as with a provider,
+// whether through the session cookie or a bearer token.
+type Identity struct {
+	// Provider is the name of the provider the identity comes from.
+	Provider string
+
+	// Subject is the provider's stable identifier for the user, taken from
+	// the ID token or the user info. It may be empty if the provider offers
+	// neither.
+	Subject string
+
+	Token  *oauth2.Token
+	Scopes []string
+
+	// Claims and UserInfo are set when available.
+	Claims   *Claims
+	UserInfo *UserInfo
+}
+
+// bearerKey is the context key for identities established by
+// BearerRequired. It includes the handler so that providers in a
+// ProviderGroup don't see each other's bearer identities.
+type bearerKey struct {
+	handler *ProviderHandler
+}
+
+func (o *ProviderHandler) bearerIdentity(ctx context.Context) (*Identity,
+	bool) {
+	id, ok := ctx.Value(bearerKey{handler: o}).(*Identity)
+	return id, ok
+}
+
+// sessionSubject returns the subject of the user logged in to the session,
+// or "" if there is none, without looking at or refreshing the token.
+func (o *ProviderHandler) sessionSubject(ctx context.Context) (string,
+	error) {
+	session, err := o.Session(ctx)
+	if err != nil {
+		return "", err
+	}
+	raw_id_token, info, err := o.storedLoginInfo(ctx, session)
+	if err != nil {
+		return "", err
+	}
+	if raw_id_token != "" {
+		claims, err := ParseClaims(raw_id_token)
+		if err != nil {
+			return "", err
+		}
+		if claims.Subject != "" {
+			return claims.Subject, nil
+		}
+	}
+	if info != nil {
+		return info.ID, nil
+	}
+	return "", nil
+}
+
+// Identity returns who the request is authenticated as with this provider,
+// or nil if it isn't. Requests that came through BearerRequired with a
+// bearer token get the identity of that token, all others the identity of
+// the logged in user.
+func (o *ProviderHandler) Identity(ctx context.Context) (*Identity, error) {
+	if id, ok := o.bearerIdentity(ctx); ok {
+		return id, nil
+	}
+	session, err := o.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := o.token(ctx, session)
+	if err != nil || token == nil {
+		return nil, err
+	}
+	id := &Identity{
+		Provider: o.provider.Name,
+		Token:    token,
+		Scopes:   o.scopes(session)}
+	raw_id_token, info, err := o.storedLoginInfo(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if raw_id_token != "" {
+		id.Claims, err = ParseClaims(raw_id_token)
+		if err != nil {
+			return nil, err
+		}
+		id.Subject = id.Claims.Subject
+	}
+	id.UserInfo = info
+	if id.Subject == "" && id.UserInfo != nil {
+		id.Subject = id.UserInfo.ID
+	}
+	return id, nil
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package fakeidp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/go-webhelp/whoauth2.v1"
+)
+
+// DeviceGrantType is the grant type of device code token requests.
+const DeviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceFlow implements the device authorization and device code token
+// endpoints. Device logins stay pending until Decide is called with the
+// user code. Issue returns the token response for an approved user code.
+type DeviceFlow struct {
+	VerificationURI string
+	Issue           func(user_code string) map[string]interface{}
+
+	mtx       sync.Mutex
+	slow_down int
+	codes     map[string]*deviceCode
+}
+
+type deviceCode struct {
+	user_code  string
+	expires    time.Time
+	decided    bool
+	approved   bool
+	slow_downs int
+}
+
+// SetSlowDown makes every new device code answer its first n polls with
+// slow_down.
+func (f *DeviceFlow) SetSlowDown(n int) {
+	f.mtx.Lock()
+	f.slow_down = n
+	f.mtx.Unlock()
+}
+
+// Authorize is the device authorization endpoint.
+func (f *DeviceFlow) Authorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+	code := &deviceCode{
+		user_code: strings.ToUpper(RandomString()[:8]),
+		expires:   time.Now().Add(10 * time.Minute)}
+	device_code := RandomString()
+
+	f.mtx.Lock()
+	if f.codes == nil {
+		f.codes = make(map[string]*deviceCode)
+	}
+	code.slow_downs = f.slow_down
+	f.codes[device_code] = code
+	f.mtx.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               device_code,
+		"user_code":                 code.user_code,
+		"verification_uri":          f.VerificationURI,
+		"verification_uri_complete": f.VerificationURI + "?user_code=" + code.user_code,
+		"expires_in":                600,
+		"interval":                  1})
+}
+
+// Token answers token requests with the device code grant type.
+func (f *DeviceFlow) Token(w http.ResponseWriter, r *http.Request) {
+	device_code := r.FormValue("device_code")
+
+	f.mtx.Lock()
+	code, exists := f.codes[device_code]
+	var status string
+	switch {
+	case !exists:
+		status = "invalid_grant"
+	case time.Now().After(code.expires):
+		status = whoauth2.ErrorExpiredToken
+	case code.slow_downs > 0:
+		code.slow_downs--
+		status = whoauth2.ErrorSlowDown
+	case !code.decided:
+		status = whoauth2.ErrorAuthorizationPending
+	case !code.approved:
+		status = whoauth2.ErrorAccessDenied
+	}
+	if exists && status != whoauth2.ErrorSlowDown &&
+		status != whoauth2.ErrorAuthorizationPending {
+		// device codes are single use, so they are gone once a poll gets a
+		// final answer.
+		delete(f.codes, device_code)
+	}
+	f.mtx.Unlock()
+
+	if status != "" {
+		WriteError(w, http.StatusBadRequest, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, f.Issue(code.user_code))
+}
+
+// Decide approves or denies the device login with the given user code.
+func (f *DeviceFlow) Decide(user_code string, approved bool) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, code := range f.codes {
+		if code.user_code == user_code && !code.decided {
+			code.decided = true
+			code.approved = approved
+			return nil
+		}
+	}
+	return fmt.Errorf("no pending device login with user code %#v",
+		user_code)
+}
+
+func writeJSON(w http.ResponseWriter, code int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(val)
+}
+
+// WriteError writes an OAuth2 error response.
+func WriteError(w http.ResponseWriter, code int, error_code string) {
+	writeJSON(w, code, map[string]string{"error": error_code})
+}
+
+// RandomString returns a random hex string for codes and tokens.
+func RandomString() string {
+	var p [16]byte
+	_, err := rand.Read(p[:])
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(p[:])
+}
@@ -0,0 +1,614 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+// Package fakeidp implements the fake OAuth2 and OpenID Connect provider
+// that whoauth2test serves to tests and whoauth2dev to applications under
+// development.
+package fakeidp // import "gopkg.in/go-webhelp/whoauth2.v1/internal/fakeidp"
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+)
+
+const (
+	// ClientID and ClientSecret are the client credentials the IDP
+	// accepts.
+	ClientID     = "whoauth2test"
+	ClientSecret = "whoauth2test-secret"
+
+	// SubjectCookie is the cookie on the IDP that picks which identity
+	// logs in. Without it, the first identity added is used.
+	SubjectCookie = "whoauth2test_subject"
+)
+
+// Identity is a user known to the IDP.
+type Identity struct {
+	Subject string
+	Email   string
+	Name    string
+	Picture string
+
+	// Claims are added to the ID token and the userinfo response, replacing
+	// the standard claims of the same name.
+	Claims map[string]interface{}
+}
+
+// IDP is a fake OAuth2 and OpenID Connect provider with authorization,
+// token, userinfo, JWKS, revocation, introspection, device authorization and
+// discovery endpoints. It logs users in without asking, as whichever
+// Identity the SubjectCookie picks, unless it has a LoginPage.
+type IDP struct {
+	key  *rsa.PrivateKey
+	kid  string
+	mux  *http.ServeMux
+	flow DeviceFlow
+	url  string
+
+	mtx             sync.Mutex
+	login_page      LoginPage
+	identities      map[string]*Identity
+	first           string
+	scopes          []string
+	lifetime        time.Duration
+	authorize_error string
+	token_error     string
+	refreshes       int
+	codes           map[string]*authCode
+	tokens          map[string]*issuedToken
+	refresh_tokens  map[string]*issuedToken
+}
+
+type authCode struct {
+	subject      string
+	redirect_uri string
+	challenge    string
+	nonce        string
+	scopes       []string
+	expires      time.Time
+}
+
+type issuedToken struct {
+	subject string
+	scopes  []string
+	expires time.Time
+}
+
+// LoginPage renders a page that lets the user pick one of identities. It
+// should send the user back to the authorization endpoint with the request's
+// form values plus a "subject" parameter, or a "cancel" parameter to turn the
+// login down.
+type LoginPage func(w http.ResponseWriter, r *http.Request,
+	identities []Identity)
+
+// New makes an IDP with the given identities. Call SetURL before it serves
+// any requests.
+func New(identities ...Identity) *IDP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	s := &IDP{
+		key:            key,
+		kid:            RandomString()[:8],
+		mux:            http.NewServeMux(),
+		identities:     make(map[string]*Identity),
+		lifetime:       time.Hour,
+		codes:          make(map[string]*authCode),
+		tokens:         make(map[string]*issuedToken),
+		refresh_tokens: make(map[string]*issuedToken)}
+	for _, id := range identities {
+		s.AddIdentity(id)
+	}
+	s.flow.Issue = func(user_code string) map[string]interface{} {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return s.issue(s.first, s.scopes, "")
+	}
+	s.mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	s.mux.HandleFunc("/authorize", s.authorize)
+	s.mux.HandleFunc("/token", s.token)
+	s.mux.HandleFunc("/userinfo", s.userinfo)
+	s.mux.HandleFunc("/jwks", s.jwks)
+	s.mux.HandleFunc("/revoke", s.revoke)
+	s.mux.HandleFunc("/introspect", s.introspect)
+	s.mux.HandleFunc("/device/code", s.flow.Authorize)
+	return s
+}
+
+// SetURL sets the URL the IDP is served at, which is also its issuer.
+func (s *IDP) SetURL(url string) {
+	s.url = strings.TrimRight(url, "/")
+	s.flow.VerificationURI = s.url + "/device"
+}
+
+// ServeHTTP implements http.Handler.
+func (s *IDP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// SetLoginPage makes the authorization endpoint show page instead of logging
+// users in right away. Users that have the SubjectCookie still skip it.
+func (s *IDP) SetLoginPage(page LoginPage) {
+	s.mtx.Lock()
+	s.login_page = page
+	s.mtx.Unlock()
+}
+
+// ServerProvider returns a whoauth2.Provider in OIDC mode for an IDP at
+// server_url. redirect_url is the provider handler's callback URL, ending in
+// /_cb.
+func ServerProvider(name, server_url, redirect_url string) *whoauth2.Provider {
+	server_url = strings.TrimRight(server_url, "/")
+	return &whoauth2.Provider{
+		Name: name,
+		Config: oauth2.Config{
+			ClientID:     ClientID,
+			ClientSecret: ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   server_url + "/authorize",
+				TokenURL:  server_url + "/token",
+				AuthStyle: oauth2.AuthStyleInHeader},
+			RedirectURL: redirect_url,
+			Scopes:      []string{"openid", "email", "profile"}},
+		OIDC:             whoauth2.NewOIDC(server_url, server_url+"/jwks"),
+		FetchUserInfo:    whoauth2.OIDCUserInfo(server_url + "/userinfo"),
+		Revoke:           whoauth2.RFC7009Revoker(server_url + "/revoke"),
+		IntrospectionURL: server_url + "/introspect",
+		DeviceAuthURL:    server_url + "/device/code"}
+}
+
+// AddIdentity adds or replaces an identity. The first identity added is the
+// one that logs in when no SubjectCookie is set.
+func (s *IDP) AddIdentity(id Identity) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.first == "" {
+		s.first = id.Subject
+	}
+	s.identities[id.Subject] = &id
+}
+
+// SetScopes makes the server grant exactly scopes, whatever was requested.
+// With no scopes, the requested scopes are granted.
+func (s *IDP) SetScopes(scopes ...string) {
+	s.mtx.Lock()
+	s.scopes = scopes
+	s.mtx.Unlock()
+}
+
+// SetTokenLifetime sets how long issued access tokens are valid. The default
+// is an hour.
+func (s *IDP) SetTokenLifetime(lifetime time.Duration) {
+	s.mtx.Lock()
+	s.lifetime = lifetime
+	s.mtx.Unlock()
+}
+
+// SetAuthorizeError makes the authorization endpoint send users back with
+// the OAuth2 error code error_code, such as whoauth2.ErrorAccessDenied. An
+// empty error_code restores normal logins.
+func (s *IDP) SetAuthorizeError(error_code string) {
+	s.mtx.Lock()
+	s.authorize_error = error_code
+	s.mtx.Unlock()
+}
+
+// SetTokenError makes the token endpoint fail every request with the OAuth2
+// error code error_code, such as "invalid_grant". An empty error_code
+// restores normal token responses.
+func (s *IDP) SetTokenError(error_code string) {
+	s.mtx.Lock()
+	s.token_error = error_code
+	s.mtx.Unlock()
+}
+
+// ExpireTokens expires every access token issued so far on the server's
+// side, so the userinfo and introspection endpoints and Active reject them.
+// Clients still go by the expiry they were issued with and won't refresh
+// because of it. To make clients refresh, issue tokens with a SetTokenLifetime
+// of a few seconds, which golang.org/x/oauth2 already considers expired.
+func (s *IDP) ExpireTokens() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, token := range s.tokens {
+		token.expires = time.Time{}
+	}
+}
+
+// Refreshes returns how many refresh token grants the token endpoint has
+// received.
+func (s *IDP) Refreshes() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.refreshes
+}
+
+// Active returns whether access_token was issued by the server and is
+// neither expired nor revoked.
+func (s *IDP) Active(access_token string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.active(access_token) != nil
+}
+
+// SetDeviceSlowDown makes every new device code answer its first n polls
+// with slow_down. Device logins are approved with ApproveDevice as the first
+// identity.
+func (s *IDP) SetDeviceSlowDown(n int) { s.flow.SetSlowDown(n) }
+
+// ApproveDevice approves the device login with the given user code.
+func (s *IDP) ApproveDevice(user_code string) error {
+	return s.flow.Decide(user_code, true)
+}
+
+// DenyDevice denies the device login with the given user code.
+func (s *IDP) DenyDevice(user_code string) error {
+	return s.flow.Decide(user_code, false)
+}
+
+func (s *IDP) active(access_token string) *issuedToken {
+	token, exists := s.tokens[access_token]
+	if !exists || time.Now().After(token.expires) {
+		return nil
+	}
+	return token
+}
+
+func (s *IDP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.url,
+		"authorization_endpoint":                s.url + "/authorize",
+		"token_endpoint":                        s.url + "/token",
+		"userinfo_endpoint":                     s.url + "/userinfo",
+		"jwks_uri":                              s.url + "/jwks",
+		"revocation_endpoint":                   s.url + "/revoke",
+		"introspection_endpoint":                s.url + "/introspect",
+		"device_authorization_endpoint":         s.url + "/device/code",
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"response_types_supported":              []string{"code"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{
+			"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported": []string{"S256"}})
+}
+
+func (s *IDP) authorize(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+	redirect_uri := q.Get("redirect_uri")
+	target, err := url.Parse(redirect_uri)
+	if q.Get("client_id") != ClientID || redirect_uri == "" || err != nil {
+		http.Error(w, "bad client_id or redirect_uri", http.StatusBadRequest)
+		return
+	}
+	back := func(vals url.Values) {
+		vals.Set("state", q.Get("state"))
+		target.RawQuery = vals.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}
+
+	subject := q.Get("subject")
+	if cookie, err := r.Cookie(SubjectCookie); err == nil && subject == "" {
+		subject = cookie.Value
+	}
+
+	s.mtx.Lock()
+	if subject == "" && q.Get("cancel") == "" && s.login_page != nil {
+		page, identities := s.login_page, s.identityList()
+		s.mtx.Unlock()
+		page(w, r, identities)
+		return
+	}
+	defer s.mtx.Unlock()
+	if subject == "" {
+		subject = q.Get("login_hint")
+	}
+	if subject == "" {
+		subject = s.first
+	}
+	error_code := s.authorize_error
+	switch {
+	case error_code != "":
+	case q.Get("cancel") != "":
+		error_code = whoauth2.ErrorAccessDenied
+	case q.Get("response_type") != "code":
+		error_code = "unsupported_response_type"
+	case s.identities[subject] == nil:
+		error_code = whoauth2.ErrorAccessDenied
+	case q.Get("code_challenge") != "" &&
+		q.Get("code_challenge_method") != "S256":
+		error_code = whoauth2.ErrorInvalidRequest
+	}
+	if error_code != "" {
+		back(url.Values{"error": {error_code}})
+		return
+	}
+
+	code := RandomString()
+	s.codes[code] = &authCode{
+		subject:      subject,
+		redirect_uri: redirect_uri,
+		challenge:    q.Get("code_challenge"),
+		nonce:        q.Get("nonce"),
+		scopes:       strings.Fields(q.Get("scope")),
+		expires:      time.Now().Add(time.Minute)}
+	back(url.Values{"code": {code}})
+}
+
+// identityList returns the identities sorted by subject. s.mtx must be held.
+func (s *IDP) identityList() []Identity {
+	identities := make([]Identity, 0, len(s.identities))
+	for _, id := range s.identities {
+		identities = append(identities, *id)
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].Subject < identities[j].Subject
+	})
+	return identities
+}
+
+// clientAuthorized checks the client credentials, from the Authorization
+// header or the form.
+func clientAuthorized(r *http.Request) bool {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	return id == ClientID &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(ClientSecret)) == 1
+}
+
+func (s *IDP) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+	grant_type := r.FormValue("grant_type")
+	if grant_type == DeviceGrantType {
+		s.flow.Token(w, r)
+		return
+	}
+	if !clientAuthorized(r) {
+		WriteError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if grant_type == "refresh_token" {
+		s.refreshes++
+	}
+	if s.token_error != "" {
+		WriteError(w, http.StatusBadRequest, s.token_error)
+		return
+	}
+	switch grant_type {
+	case "authorization_code":
+		code, exists := s.codes[r.FormValue("code")]
+		// codes are single use
+		delete(s.codes, r.FormValue("code"))
+		if !exists || time.Now().After(code.expires) ||
+			code.redirect_uri != r.FormValue("redirect_uri") ||
+			!verifierMatches(code.challenge, r.FormValue("code_verifier")) {
+			WriteError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		scopes := code.scopes
+		if len(s.scopes) > 0 {
+			scopes = s.scopes
+		}
+		writeJSON(w, http.StatusOK, s.issue(code.subject, scopes, code.nonce))
+	case "refresh_token":
+		refresh, exists := s.refresh_tokens[r.FormValue("refresh_token")]
+		if !exists {
+			WriteError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		// refresh tokens are rotated
+		delete(s.refresh_tokens, r.FormValue("refresh_token"))
+		writeJSON(w, http.StatusOK, s.issue(refresh.subject, refresh.scopes,
+			""))
+	default:
+		WriteError(w, http.StatusBadRequest, "unsupported_grant_type")
+	}
+}
+
+func verifierMatches(challenge, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
+
+// issue makes a token response for subject. s.mtx must be held.
+func (s *IDP) issue(subject string, scopes []string,
+	nonce string) map[string]interface{} {
+	access_token := RandomString()
+	refresh_token := RandomString()
+	token := &issuedToken{
+		subject: subject,
+		scopes:  scopes,
+		expires: time.Now().Add(s.lifetime)}
+	s.tokens[access_token] = token
+	s.refresh_tokens[refresh_token] = token
+	resp := map[string]interface{}{
+		"access_token":  access_token,
+		"refresh_token": refresh_token,
+		"token_type":    "Bearer",
+		"expires_in":    int64(s.lifetime / time.Second),
+		"scope":         strings.Join(scopes, " ")}
+	for _, scope := range scopes {
+		if scope == "openid" {
+			resp["id_token"] = s.idToken(subject, nonce)
+		}
+	}
+	return resp
+}
+
+// claims returns the standard claims for subject plus the identity's custom
+// ones. s.mtx must be held.
+func (s *IDP) claims(subject string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": subject}
+	id, exists := s.identities[subject]
+	if !exists {
+		return claims
+	}
+	if id.Email != "" {
+		claims["email"] = id.Email
+		claims["email_verified"] = true
+	}
+	if id.Name != "" {
+		claims["name"] = id.Name
+	}
+	if id.Picture != "" {
+		claims["picture"] = id.Picture
+	}
+	for name, val := range id.Claims {
+		claims[name] = val
+	}
+	return claims
+}
+
+func (s *IDP) idToken(subject, nonce string) string {
+	now := time.Now()
+	claims := s.claims(subject)
+	claims["iss"] = s.url
+	claims["aud"] = ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(s.lifetime).Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	return s.Sign(claims)
+}
+
+// Sign returns a JWT with claims, signed with the server's key, for tests
+// that need to craft tokens of their own.
+func (s *IDP) Sign(claims map[string]interface{}) string {
+	return s.sign("JWT", claims)
+}
+
+// SignAccessToken is like Sign, but marks the JWT as an RFC 9068 access
+// token.
+func (s *IDP) SignAccessToken(claims map[string]interface{}) string {
+	return s.sign("at+jwt", claims)
+}
+
+func (s *IDP) sign(typ string, claims map[string]interface{}) string {
+	encode := func(val interface{}) string {
+		data, err := json.Marshal(val)
+		if err != nil {
+			panic(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{
+		"alg": "RS256", "typ": typ, "kid": s.kid}) + "." + encode(claims)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256,
+		sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (s *IDP) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": s.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(
+				big.NewInt(int64(s.key.E)).Bytes())}}})
+}
+
+func (s *IDP) userinfo(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		WriteError(w, http.StatusUnauthorized, "invalid_token")
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	token := s.active(strings.TrimPrefix(auth, "Bearer "))
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		WriteError(w, http.StatusUnauthorized, "invalid_token")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.claims(token.subject))
+}
+
+func (s *IDP) revoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !clientAuthorized(r) {
+		WriteError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	value := r.FormValue("token")
+	// revoking either token of a grant revokes both, as RFC 7009 allows.
+	token := s.tokens[value]
+	if token == nil {
+		token = s.refresh_tokens[value]
+	}
+	for access_token, other := range s.tokens {
+		if other == token {
+			delete(s.tokens, access_token)
+		}
+	}
+	for refresh_token, other := range s.refresh_tokens {
+		if other == token {
+			delete(s.refresh_tokens, refresh_token)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *IDP) introspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !clientAuthorized(r) {
+		WriteError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	token := s.active(r.FormValue("token"))
+	if token == nil {
+		writeJSON(w, http.StatusOK, map[string]bool{"active": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"active":    true,
+		"sub":       token.subject,
+		"client_id": ClientID,
+		"scope":     strings.Join(token.scopes, " "),
+		"exp":       token.expires.Unix()})
+}
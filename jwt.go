@@ -0,0 +1,260 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// keySetMaxAge is how long fetched signing keys are trusted before they
+	// are fetched again.
+	keySetMaxAge = time.Hour
+
+	// keySetMinRefresh rate limits refetches caused by unknown key ids.
+	keySetMinRefresh = 10 * time.Second
+)
+
+// jwt is a parsed, but not yet verified, compact JWS.
+type jwt struct {
+	Header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		Typ string `json:"typ"`
+	}
+	Payload   []byte
+	signed    string
+	signature []byte
+}
+
+func parseJWT(raw string) (*jwt, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt payload: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt signature: %v", err)
+	}
+	t := &jwt{
+		Payload:   payload,
+		signed:    parts[0] + "." + parts[1],
+		signature: signature}
+	err = json.Unmarshal(header, &t.Header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	return t, nil
+}
+
+// verify checks the JWT's signature against key.
+func (t *jwt) verify(key crypto.PublicKey) error {
+	var hash crypto.Hash
+	switch t.Header.Alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %#v", t.Header.Alg)
+	}
+	h := hash.New()
+	h.Write([]byte(t.signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch t.Header.Alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, t.signature)
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, t.signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		if t.Header.Alg[:2] != "ES" {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return fmt.Errorf("invalid jwt signature length")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("jwt algorithm %#v does not match key type",
+		t.Header.Alg)
+}
+
+// jsonWebKey is the subset of RFC 7517 needed for signature checks.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(val string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(val)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %#v", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %#v", k.Kty)
+}
+
+// keySet is a cached copy of an issuer's JSON Web Key Set.
+type keySet struct {
+	url string
+
+	mtx     sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// key returns the signing key with the given id, fetching the key set again
+// if it is stale or doesn't know about kid yet.
+func (s *keySet) key(ctx context.Context, kid string) (crypto.PublicKey,
+	error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	age := time.Since(s.fetched)
+	key, found := s.lookup(kid)
+	if found && age < keySetMaxAge {
+		return key, nil
+	}
+	if s.keys == nil || age > keySetMinRefresh {
+		keys, err := fetchKeySet(ctx, s.url)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = keys
+		s.fetched = time.Now()
+		key, found = s.lookup(kid)
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown signing key %#v", kid)
+	}
+	return key, nil
+}
+
+func (s *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, found := s.keys[kid]
+	return key, found
+}
+
+func fetchKeySet(ctx context.Context, url string) (
+	map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := getJSON(ctx, contextClient(ctx), url, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// skip keys we don't understand, the issuer may publish keys
+			// for algorithms we don't need.
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// getJSON GETs url with client and decodes the JSON response into val.
+func getJSON(ctx context.Context, client *http.Client, url string,
+	val interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(val)
+}
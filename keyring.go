@@ -0,0 +1,103 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+const (
+	sealVersion = 1
+	keyIDSize   = 4
+)
+
+// KeyRing holds the AES keys used to encrypt tokens at rest with AES-GCM.
+// The primary key encrypts everything that is written. The other keys are
+// only used to decrypt tokens written before a key rotation, and such tokens
+// are re-encrypted with the primary key the next time they are saved. Once
+// every active session has been saved again, old keys can be dropped.
+type KeyRing struct {
+	primary *ringKey
+	keys    map[[keyIDSize]byte]*ringKey
+}
+
+type ringKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// NewKeyRing makes a KeyRing. Keys must be 16, 24 or 32 bytes long, for
+// AES-128, AES-192 or AES-256.
+func NewKeyRing(primary []byte, old ...[]byte) (*KeyRing, error) {
+	k := &KeyRing{keys: make(map[[keyIDSize]byte]*ringKey, 1+len(old))}
+	for i, secret := range append([][]byte{primary}, old...) {
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		key := &ringKey{aead: aead}
+		sum := sha256.Sum256(secret)
+		copy(key.id[:], sum[:])
+		if _, exists := k.keys[key.id]; exists {
+			return nil, fmt.Errorf("duplicate or colliding key ring keys")
+		}
+		k.keys[key.id] = key
+		if i == 0 {
+			k.primary = key
+		}
+	}
+	return k, nil
+}
+
+// seal encrypts plaintext with the primary key. additional_data isn't
+// encrypted but has to match when opening.
+func (k *KeyRing) seal(plaintext, additional_data []byte) []byte {
+	key := k.primary
+	header := append([]byte{sealVersion}, key.id[:]...)
+	nonce := make([]byte, key.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+
+		key.aead.Overhead())
+	out = append(append(out, header...), nonce...)
+	return key.aead.Seal(out, nonce, plaintext,
+		append(header, additional_data...))
+}
+
+// open decrypts data from seal. rotated is true if data wasn't encrypted
+// with the primary key and should be sealed again.
+func (k *KeyRing) open(data, additional_data []byte) (plaintext []byte,
+	rotated bool, err error) {
+	if len(data) < 1+keyIDSize || data[0] != sealVersion {
+		return nil, false, fmt.Errorf("unknown encrypted token format")
+	}
+	var id [keyIDSize]byte
+	copy(id[:], data[1:])
+	key, exists := k.keys[id]
+	if !exists {
+		return nil, false, fmt.Errorf("token encrypted with unknown key")
+	}
+	header := data[:1+keyIDSize]
+	data = data[1+keyIDSize:]
+	if len(data) < key.aead.NonceSize() {
+		return nil, false, fmt.Errorf("truncated encrypted token")
+	}
+	nonce, data := data[:key.aead.NonceSize()], data[key.aead.NonceSize():]
+	plaintext, err = key.aead.Open(nil, nonce, data,
+		append(append([]byte(nil), header...), additional_data...))
+	if err != nil {
+		return nil, false, err
+	}
+	return plaintext, key != k.primary, nil
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyRing(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	key3 := bytes.Repeat([]byte{3}, 24)
+	ring := func(primary []byte, old ...[]byte) *KeyRing {
+		k, err := NewKeyRing(primary, old...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	plaintext := []byte("token")
+	sealed := ring(key1).seal(plaintext, []byte("ns"))
+
+	for _, test := range []struct {
+		name    string
+		ring    *KeyRing
+		ad      string
+		ok      bool
+		rotated bool
+	}{
+		{"same key", ring(key1), "ns", true, false},
+		{"old key", ring(key2, key3, key1), "ns", true, true},
+		{"dropped key", ring(key2, key3), "ns", false, false},
+		{"other namespace", ring(key1), "other", false, false},
+	} {
+		got, rotated, err := test.ring.open(sealed, []byte(test.ad))
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, plaintext) || rotated != test.rotated {
+			t.Errorf("%s: got %q, rotated %v", test.name, got, rotated)
+		}
+	}
+
+	// rotated tokens are sealed again with the new primary key, after which
+	// the old key isn't needed anymore.
+	resealed := ring(key2, key1).seal(plaintext, []byte("ns"))
+	got, rotated, err := ring(key2).open(resealed, []byte("ns"))
+	if err != nil || rotated || !bytes.Equal(got, plaintext) {
+		t.Errorf("resealed: got %q, %v, %v", got, rotated, err)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := ring(key1).open(tampered, []byte("ns")); err == nil {
+		t.Errorf("tampered: expected an error")
+	}
+	if _, _, err := ring(key1).open(sealed[:3], []byte("ns")); err == nil {
+		t.Errorf("truncated: expected an error")
+	}
+}
+
+func TestNewKeyRing(t *testing.T) {
+	if _, err := NewKeyRing([]byte("short")); err == nil {
+		t.Errorf("expected an error for a bad key size")
+	}
+	key := bytes.Repeat([]byte{1}, 16)
+	if _, err := NewKeyRing(key, key); err == nil {
+		t.Errorf("expected an error for duplicate keys")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/webhelp.v1/wherr"
+)
+
+var (
+	// TenantNotAllowed is the error class for Microsoft logins from a tenant
+	// the provider doesn't accept.
+	TenantNotAllowed = wherr.Forbidden.NewClass("tenant not allowed")
+)
+
+const (
+	microsoftLoginURL = "https://login.microsoftonline.com/"
+
+	// MicrosoftConsumersTenant is the tenant ID of personal Microsoft
+	// accounts.
+	MicrosoftConsumersTenant = "9188040d-6c67-4c5b-b112-36a304b66dad"
+)
+
+// Microsoft returns a provider for the Microsoft identity platform (Entra
+// ID, formerly Azure AD) in OIDC mode. tenant is the directory users log in
+// to: a tenant ID or domain for single-tenant apps, "organizations" for any
+// work or school account, "consumers" for personal accounts, or "common" for
+// both. ID tokens have to come from the chosen tenant, and if
+// allowed_tenants are given, from one of those tenant IDs as well. A domain
+// is resolved to its tenant ID through the tenant's discovery document the
+// first time a token is checked. See
+// MicrosoftTenant, MicrosoftGroups and MicrosoftRoles for Microsoft specific
+// claims.
+func Microsoft(conf Config, tenant string,
+	allowed_tenants ...string) *Provider {
+	if conf.Endpoint.AuthURL == "" {
+		conf.Endpoint = oauth2.Endpoint{
+			AuthURL:  microsoftLoginURL + tenant + "/oauth2/v2.0/authorize",
+			TokenURL: microsoftLoginURL + tenant + "/oauth2/v2.0/token"}
+	}
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"openid", "email", "profile"}
+	} else if !contains(conf.Scopes, "openid") {
+		conf.Scopes = append([]string{"openid"}, conf.Scopes...)
+	}
+	oidc := NewOIDC(microsoftLoginURL+tenant+"/v2.0",
+		microsoftLoginURL+tenant+"/discovery/v2.0/keys")
+	oidc.CheckIssuer = microsoftIssuerCheck(tenant, allowed_tenants)
+	return &Provider{
+		Name:   "microsoft",
+		Config: oauth2.Config(conf),
+		OIDC:   oidc,
+		FetchUserInfo: OIDCUserInfo(
+			"https://graph.microsoft.com/oidc/userinfo"),
+		DeviceAuthURL: microsoftLoginURL + tenant + "/oauth2/v2.0/devicecode"}
+}
+
+// microsoftIssuerCheck returns an OIDC.CheckIssuer for tenant. Tokens from
+// the multi-tenant endpoints name the user's own tenant in their issuer, so
+// the issuer is checked against the "tid" claim, and the "tid" claim against
+// tenant and allowed_tenants.
+func microsoftIssuerCheck(tenant string, allowed_tenants []string) func(
+	ctx context.Context, claims *Claims) error {
+	domain := &microsoftDomain{domain: tenant}
+	return func(ctx context.Context, claims *Claims) error {
+		tid := MicrosoftTenant(claims)
+		if tid == "" {
+			return IDTokenError.New("no tid claim")
+		}
+		if claims.Issuer != microsoftLoginURL+tid+"/v2.0" {
+			return IDTokenError.New("unexpected issuer %#v", claims.Issuer)
+		}
+		switch tenant {
+		case "common":
+		case "organizations":
+			if tid == MicrosoftConsumersTenant {
+				return TenantNotAllowed.New("personal accounts not allowed")
+			}
+		case "consumers":
+			if tid != MicrosoftConsumersTenant {
+				return TenantNotAllowed.New("only personal accounts allowed")
+			}
+		default:
+			tenant_id := tenant
+			if !isGUID(tenant) {
+				var err error
+				tenant_id, err = domain.tenantID(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			if !strings.EqualFold(tid, tenant_id) {
+				return TenantNotAllowed.New("tenant %s", tid)
+			}
+		}
+		if len(allowed_tenants) == 0 {
+			return nil
+		}
+		for _, allowed := range allowed_tenants {
+			if strings.EqualFold(tid, allowed) {
+				return nil
+			}
+		}
+		return TenantNotAllowed.New("tenant %s", tid)
+	}
+}
+
+// microsoftDomain resolves a tenant's domain name to its tenant ID, which
+// only the tenant's discovery document ties it to.
+type microsoftDomain struct {
+	domain string
+
+	mtx sync.Mutex
+	id  string
+}
+
+// tenantID returns the tenant ID of the domain, looking it up the first time.
+// Failed lookups are retried on the next call.
+func (d *microsoftDomain) tenantID(ctx context.Context) (string, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.id != "" {
+		return d.id, nil
+	}
+	var md struct {
+		Issuer string `json:"issuer"`
+	}
+	err := getJSON(ctx, contextClient(ctx), microsoftLoginURL+d.domain+
+		"/v2.0/.well-known/openid-configuration", &md)
+	if err != nil {
+		return "", IDTokenError.New("resolving tenant %s: %v", d.domain, err)
+	}
+	id := strings.TrimSuffix(
+		strings.TrimPrefix(md.Issuer, microsoftLoginURL), "/v2.0")
+	if !isGUID(id) {
+		return "", IDTokenError.New("resolving tenant %s: unexpected "+
+			"issuer %#v", d.domain, md.Issuer)
+	}
+	d.id = id
+	return id, nil
+}
+
+func isGUID(val string) bool {
+	if len(val) != 36 {
+		return false
+	}
+	for i, c := range val {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' ||
+				'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// MicrosoftTenant returns the tenant ID from the "tid" claim of a Microsoft
+// ID token.
+func MicrosoftTenant(claims *Claims) string {
+	tid, _ := claims.Raw["tid"].(string)
+	return tid
+}
+
+// MicrosoftGroups returns the group object IDs from the "groups" claim of a
+// Microsoft ID token. The claim has to be turned on in the app registration.
+// Users in too many groups get no "groups" claim, and overage is then true;
+// their groups have to be looked up with the Microsoft Graph API.
+func MicrosoftGroups(claims *Claims) (groups []string, overage bool) {
+	if names, ok := claims.Raw["_claim_names"].(map[string]interface{}); ok {
+		_, overage = names["groups"]
+	}
+	return stringsClaim(claims, "groups"), overage
+}
+
+// MicrosoftRoles returns the app roles from the "roles" claim of a Microsoft
+// ID token.
+func MicrosoftRoles(claims *Claims) []string {
+	return stringsClaim(claims, "roles")
+}
+
+// stringsClaim returns the claim name as a list of strings.
+func stringsClaim(claims *Claims, name string) []string {
+	vals, _ := claims.Raw[name].([]interface{})
+	rv := make([]string, 0, len(vals))
+	for _, val := range vals {
+		if s, ok := val.(string); ok {
+			rv = append(rv, s)
+		}
+	}
+	return rv
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spacemonkeygo/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+)
+
+const (
+	contosoTenant  = "72f988bf-86f1-41af-91ab-2d7cd011db47"
+	fabrikamTenant = "0d1c8b9a-3f2e-4d5c-8b7a-6e5f4d3c2b1a"
+
+	graphMemberObjects = "https://graph.microsoft.com/v1.0/users/alice/" +
+		"getMemberObjects"
+)
+
+// microsoftTransport stands in for login.microsoftonline.com. It serves the
+// fake server's signing keys for every tenant, and discovery documents for
+// the domains it knows the tenant IDs of.
+type microsoftTransport struct {
+	idp     *whoauth2test.Server
+	domains map[string]string
+}
+
+func (t *microsoftTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	if req.URL.Host != "login.microsoftonline.com" {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	if strings.HasSuffix(req.URL.Path, "/discovery/v2.0/keys") {
+		return http.Get(t.idp.URL + "/jwks")
+	}
+	rec := httptest.NewRecorder()
+	domain := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/"),
+		"/v2.0/.well-known/openid-configuration")
+	if tenant, exists := t.domains[domain]; exists {
+		rec.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rec).Encode(map[string]string{
+			"issuer": "https://login.microsoftonline.com/" + tenant + "/v2.0"})
+	} else {
+		http.NotFound(rec, req)
+	}
+	return rec.Result(), nil
+}
+
+// microsoftToken returns an ID token from tenant tid, with an issuer for
+// iss_tid, and extra claims.
+func microsoftToken(idp *whoauth2test.Server, tid, iss_tid string,
+	extra map[string]interface{}) string {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": "https://login.microsoftonline.com/" + iss_tid + "/v2.0",
+		"sub": "alice",
+		"aud": "client",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix()}
+	if tid != "" {
+		claims["tid"] = tid
+	}
+	for name, val := range extra {
+		claims[name] = val
+	}
+	return idp.Sign(claims)
+}
+
+func TestMicrosoftIssuer(t *testing.T) {
+	idp := whoauth2test.NewServer()
+	defer idp.Close()
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient,
+		&http.Client{Transport: &microsoftTransport{idp: idp,
+			domains: map[string]string{"contoso.com": contosoTenant}}})
+	consumers := whoauth2.MicrosoftConsumersTenant
+
+	for _, test := range []struct {
+		tenant  string
+		allowed []string
+		tid     string
+		iss_tid string
+		class   *errors.ErrorClass
+	}{
+		{"common", nil, contosoTenant, contosoTenant, nil},
+		{"common", nil, consumers, consumers, nil},
+		{"common", nil, contosoTenant, fabrikamTenant, whoauth2.IDTokenError},
+		{"common", nil, "", contosoTenant, whoauth2.IDTokenError},
+		{"common", []string{fabrikamTenant}, contosoTenant, contosoTenant,
+			whoauth2.TenantNotAllowed},
+		{"common", []string{strings.ToUpper(contosoTenant)}, contosoTenant,
+			contosoTenant, nil},
+
+		{"organizations", nil, contosoTenant, contosoTenant, nil},
+		{"organizations", nil, consumers, consumers,
+			whoauth2.TenantNotAllowed},
+
+		{"consumers", nil, consumers, consumers, nil},
+		{"consumers", nil, contosoTenant, contosoTenant,
+			whoauth2.TenantNotAllowed},
+
+		{contosoTenant, nil, contosoTenant, contosoTenant, nil},
+		{strings.ToUpper(contosoTenant), nil, contosoTenant, contosoTenant,
+			nil},
+		{contosoTenant, nil, fabrikamTenant, fabrikamTenant,
+			whoauth2.TenantNotAllowed},
+		{contosoTenant, nil, fabrikamTenant, contosoTenant,
+			whoauth2.IDTokenError},
+
+		{"contoso.com", nil, contosoTenant, contosoTenant, nil},
+		{"contoso.com", nil, fabrikamTenant, fabrikamTenant,
+			whoauth2.TenantNotAllowed},
+		{"unknown.example", nil, contosoTenant, contosoTenant,
+			whoauth2.IDTokenError},
+	} {
+		provider := whoauth2.Microsoft(whoauth2.Config{ClientID: "client"},
+			test.tenant, test.allowed...)
+		_, err := provider.OIDC.Verify(ctx, "client",
+			microsoftToken(idp, test.tid, test.iss_tid, nil))
+		if test.class == nil && err != nil ||
+			test.class != nil && !test.class.Contains(err) {
+			t.Errorf("tenant %s, allowed %v, tid %#v, issuer for %s: got %v",
+				test.tenant, test.allowed, test.tid, test.iss_tid, err)
+		}
+	}
+}
+
+func TestMicrosoftGroups(t *testing.T) {
+	idp := whoauth2test.NewServer()
+	defer idp.Close()
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient,
+		&http.Client{Transport: &microsoftTransport{idp: idp}})
+	provider := whoauth2.Microsoft(whoauth2.Config{ClientID: "client"},
+		"common")
+
+	for _, test := range []struct {
+		name    string
+		extra   map[string]interface{}
+		groups  []string
+		overage bool
+		roles   []string
+	}{
+		{"none", nil, []string{}, false, []string{}},
+		{"groups and roles", map[string]interface{}{
+			"groups": []string{"g1", "g2"},
+			"roles":  []string{"admin"}},
+			[]string{"g1", "g2"}, false, []string{"admin"}},
+		// users in too many groups get a pointer to the Graph API instead.
+		{"overage", map[string]interface{}{
+			"_claim_names": map[string]string{"groups": "src1"},
+			"_claim_sources": map[string]interface{}{
+				"src1": map[string]string{"endpoint": graphMemberObjects}}},
+			[]string{}, true, []string{}},
+	} {
+		claims, err := provider.OIDC.Verify(ctx, "client",
+			microsoftToken(idp, contosoTenant, contosoTenant, test.extra))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if tid := whoauth2.MicrosoftTenant(claims); tid != contosoTenant {
+			t.Errorf("%s: got tenant %#v", test.name, tid)
+		}
+		groups, overage := whoauth2.MicrosoftGroups(claims)
+		if !reflect.DeepEqual(groups, test.groups) || overage != test.overage {
+			t.Errorf("%s: got groups %v, overage %v", test.name, groups,
+				overage)
+		}
+		if roles := whoauth2.MicrosoftRoles(claims); !reflect.DeepEqual(roles,
+			test.roles) {
+			t.Errorf("%s: got roles %v", test.name, roles)
+		}
+	}
+}
@@ -6,6 +6,15 @@ package whoauth2
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/webhelp.v1/whcompat"
+	"gopkg.in/webhelp.v1/whroute"
+	"gopkg.in/webhelp.v1/whsess"
 )
 
 // RedirectURLs contains a collection of URLs to redirect to in a variety
@@ -18,6 +27,70 @@ type RedirectURLs struct {
 	// If a logout URL isn't provided to redirect to after successful logout, use
 	// this one.
 	DefaultLogoutURL string
+
+	// If set, users are sent here when the provider turns a login down, for
+	// instance because they denied access. The error and error_description
+	// query parameters describe why.
+	LoginErrorURL string
+
+	// By default, user supplied redirect_to values must be relative paths on
+	// the same origin. AllowedHosts additionally allows absolute http and
+	// https URLs to these hosts.
+	AllowedHosts []string
+
+	// If set, ValidateRedirect is asked about any redirect_to value the rules
+	// above reject, and may allow it by returning true.
+	ValidateRedirect func(r *http.Request, redirect_to string) bool
+
+	// If set, OnRejectedRedirect is called with every redirect_to value that
+	// is rejected and replaced with DefaultLoginURL or DefaultLogoutURL.
+	OnRejectedRedirect func(r *http.Request, redirect_to string)
+}
+
+// redirectTarget returns redirect_to if it is an allowed redirect target,
+// and fallback otherwise.
+func (u *RedirectURLs) redirectTarget(r *http.Request, redirect_to,
+	fallback string) string {
+	if redirect_to == "" {
+		return fallback
+	}
+	if u.allowed(redirect_to) ||
+		(u.ValidateRedirect != nil && u.ValidateRedirect(r, redirect_to)) {
+		return redirect_to
+	}
+	if u.OnRejectedRedirect != nil {
+		u.OnRejectedRedirect(r, redirect_to)
+	}
+	return fallback
+}
+
+func (u *RedirectURLs) allowed(redirect_to string) bool {
+	// browsers treat backslashes like slashes and strip some control
+	// characters, either of which can turn a path into a different host.
+	for _, c := range redirect_to {
+		if c == '\\' || c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	parsed, err := url.Parse(redirect_to)
+	if err != nil {
+		return false
+	}
+	if parsed.Scheme == "" && parsed.Host == "" && parsed.User == nil {
+		return strings.HasPrefix(redirect_to, "/") &&
+			!strings.HasPrefix(redirect_to, "//")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" ||
+		parsed.User != nil {
+		return false
+	}
+	for _, host := range u.AllowedHosts {
+		if strings.EqualFold(parsed.Host, host) ||
+			strings.EqualFold(parsed.Hostname(), host) {
+			return true
+		}
+	}
+	return false
 }
 
 func newState() string {
@@ -28,3 +101,61 @@ func newState() string {
 	}
 	return hex.EncodeToString(p[:])
 }
+
+// contextClient returns the *http.Client stored in ctx under oauth2.HTTPClient,
+// the same way the oauth2 package chooses its client, falling back to
+// http.DefaultClient.
+func contextClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return client
+	}
+	return http.DefaultClient
+}
+
+type responseWriterKey int
+
+// withResponseWriter remembers w in the request context so that token
+// refreshes that happen further down the handler chain can be saved to the
+// session.
+func withResponseWriter(r *http.Request,
+	w http.ResponseWriter) *http.Request {
+	return whcompat.WithContext(r, context.WithValue(whcompat.Context(r),
+		responseWriterKey(0), w))
+}
+
+// SaveRefreshedTokens is a middleware that lets handlers further down the
+// chain call Token, Identity and the like on any ProviderHandler or
+// ProviderGroup and have refreshed tokens saved to the session. It is only
+// needed for handlers that aren't already behind LoginRequired,
+// RequireScopes or BearerOrLoginRequired, and only if no TokenStore is set.
+func SaveRefreshedTokens(h http.Handler) http.Handler {
+	return whroute.HandlerFunc(h,
+		func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, withResponseWriter(r, w))
+		})
+}
+
+func responseWriter(ctx context.Context) (http.ResponseWriter, bool) {
+	w, ok := ctx.Value(responseWriterKey(0)).(http.ResponseWriter)
+	return w, ok
+}
+
+func contains(list []string, val string) bool {
+	for _, s := range list {
+		if s == val {
+			return true
+		}
+	}
+	return false
+}
+
+// setOrDelete stores val in the session under key if set is true, and
+// removes key otherwise.
+func setOrDelete(session *whsess.Session, key string, val interface{},
+	set bool) {
+	if set {
+		session.Values[key] = val
+	} else {
+		delete(session.Values, key)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/webhelp.v1/wherr"
+)
+
+var (
+	// IDTokenError is the error class for ID tokens that fail verification.
+	IDTokenError = wherr.Unauthorized.NewClass("invalid id token")
+)
+
+// clockSkew is how much leeway is given when checking token timestamps.
+const clockSkew = time.Minute
+
+// Claims holds the verified claims of an OpenID Connect ID token.
+type Claims struct {
+	Issuer        string
+	Subject       string
+	Audience      []string
+	Expiry        time.Time
+	IssuedAt      time.Time
+	Nonce         string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+
+	// Raw contains every claim in the token, including the ones above.
+	Raw map[string]interface{}
+}
+
+// ParseClaims decodes the payload of a JWT without verifying it. Only use it
+// on tokens that have already been verified.
+func ParseClaims(raw_id_token string) (*Claims, error) {
+	t, err := parseJWT(raw_id_token)
+	if err != nil {
+		return nil, err
+	}
+	return parseClaims(t.Payload)
+}
+
+func parseClaims(payload []byte) (*Claims, error) {
+	var c struct {
+		Issuer        string          `json:"iss"`
+		Subject       string          `json:"sub"`
+		Audience      json.RawMessage `json:"aud"`
+		Expiry        float64         `json:"exp"`
+		IssuedAt      float64         `json:"iat"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified interface{}     `json:"email_verified"`
+		Name          string          `json:"name"`
+		Picture       string          `json:"picture"`
+	}
+	err := json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	claims := &Claims{
+		Issuer:   c.Issuer,
+		Subject:  c.Subject,
+		Expiry:   unixTime(c.Expiry),
+		IssuedAt: unixTime(c.IssuedAt),
+		Nonce:    c.Nonce,
+		Email:    c.Email,
+		Name:     c.Name,
+		Picture:  c.Picture}
+	// some providers send email_verified as a string
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		claims.EmailVerified = v
+	case string:
+		claims.EmailVerified = v == "true"
+	}
+	claims.Audience, err = parseAudience(c.Audience)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(payload, &claims.Raw)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// parseAudience parses an "aud" claim, which is either a single string or a
+// list of them.
+func parseAudience(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []string{single}, nil
+	}
+	var audience []string
+	err := json.Unmarshal(raw, &audience)
+	if err != nil {
+		return nil, fmt.Errorf("malformed aud claim: %v", err)
+	}
+	return audience, nil
+}
+
+func unixTime(seconds float64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(seconds), 0)
+}
+
+// OIDC verifies OpenID Connect ID tokens from a single issuer. Providers
+// with a non-nil OIDC field request an ID token on login, verify it in the
+// callback, and make its claims available through Claims.
+type OIDC struct {
+	// Issuer is the expected value of the "iss" claim.
+	Issuer string
+
+	// JWKSURL is where the issuer publishes its signing keys.
+	JWKSURL string
+
+	// CheckIssuer, if set, replaces the comparison of the "iss" claim with
+	// Issuer, for multi-tenant providers whose issuer depends on the user.
+	// It is called with the claims of a token whose signature is valid.
+	CheckIssuer func(ctx context.Context, claims *Claims) error
+
+	keysOnce sync.Once
+	keys     *keySet
+}
+
+// NewOIDC returns an ID token verifier for issuer whose keys are published
+// at jwks_url.
+func NewOIDC(issuer, jwks_url string) *OIDC {
+	return &OIDC{Issuer: issuer, JWKSURL: jwks_url}
+}
+
+func (o *OIDC) keySet() *keySet {
+	o.keysOnce.Do(func() { o.keys = &keySet{url: o.JWKSURL} })
+	return o.keys
+}
+
+// Verify checks raw_id_token's signature, issuer, audience and expiry, and
+// returns its claims. Checking the nonce is left to the caller.
+func (o *OIDC) Verify(ctx context.Context, client_id, raw_id_token string) (
+	*Claims, error) {
+	_, claims, err := o.verify(ctx, raw_id_token)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.hasAudience(client_id) {
+		return nil, IDTokenError.New("token not issued for %#v", client_id)
+	}
+	if azp, ok := claims.Raw["azp"].(string); ok && azp != client_id {
+		return nil, IDTokenError.New("token authorized for %#v", azp)
+	}
+	return claims, nil
+}
+
+// verify checks the signature, issuer and expiry of a JWT from the issuer,
+// but not what the token is for.
+func (o *OIDC) verify(ctx context.Context, raw string) (*jwt, *Claims,
+	error) {
+	t, err := parseJWT(raw)
+	if err != nil {
+		return nil, nil, IDTokenError.Wrap(err)
+	}
+	key, err := o.keySet().key(ctx, t.Header.Kid)
+	if err != nil {
+		return nil, nil, IDTokenError.Wrap(err)
+	}
+	err = t.verify(key)
+	if err != nil {
+		return nil, nil, IDTokenError.Wrap(err)
+	}
+	claims, err := parseClaims(t.Payload)
+	if err != nil {
+		return nil, nil, IDTokenError.Wrap(err)
+	}
+	if o.CheckIssuer != nil {
+		err = o.CheckIssuer(ctx, claims)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if claims.Issuer != o.Issuer {
+		return nil, nil, IDTokenError.New("unexpected issuer %#v",
+			claims.Issuer)
+	}
+	now := time.Now()
+	if claims.Expiry.IsZero() || now.After(claims.Expiry.Add(clockSkew)) {
+		return nil, nil, IDTokenError.New("token expired")
+	}
+	if now.Add(clockSkew).Before(claims.IssuedAt) {
+		return nil, nil, IDTokenError.New("token issued in the future")
+	}
+	return t, claims, nil
+}
+
+func (c *Claims) hasAudience(aud string) bool {
+	for _, a := range c.Audience {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableOIDC turns on OpenID Connect mode for the provider by discovering
+// issuer's metadata. Endpoints and FetchUserInfo are filled in from the
+// metadata if not already configured, and the "openid" scope is added if
+// missing.
+func (p *Provider) EnableOIDC(ctx context.Context, issuer string) error {
+	md, err := fetchMetadata(ctx, issuer)
+	if err != nil {
+		return err
+	}
+	if p.Endpoint.AuthURL == "" {
+		p.Endpoint.AuthURL = md.AuthorizationEndpoint
+	}
+	if p.Endpoint.TokenURL == "" {
+		p.Endpoint.TokenURL = md.TokenEndpoint
+	}
+	if !contains(p.Scopes, "openid") {
+		p.Scopes = append([]string{"openid"}, p.Scopes...)
+	}
+	if p.FetchUserInfo == nil && md.UserInfoEndpoint != "" {
+		p.FetchUserInfo = OIDCUserInfo(md.UserInfoEndpoint)
+	}
+	p.OIDC = NewOIDC(md.Issuer, md.JWKSURI)
+	return nil
+}
@@ -0,0 +1,323 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+	"gopkg.in/webhelp.v1/whcompat"
+)
+
+func TestOIDCVerify(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	other := whoauth2test.NewServer()
+	defer other.Close()
+
+	oidc := whoauth2.NewOIDC(idp.URL, idp.URL+"/jwks")
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": idp.URL,
+			"sub": "alice",
+			"aud": whoauth2test.ClientID,
+			"iat": now.Unix(),
+			"exp": now.Add(time.Hour).Unix()}
+		for name, val := range changes {
+			if val == nil {
+				delete(c, name)
+			} else {
+				c[name] = val
+			}
+		}
+		return c
+	}
+	tamper := func(token string) string {
+		parts := strings.Split(token, ".")
+		other_parts := strings.Split(idp.Sign(claims(map[string]interface{}{
+			"sub": "mallory"})), ".")
+		return parts[0] + "." + other_parts[1] + "." + parts[2]
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", idp.Sign(claims(nil)), true},
+		{"audience list", idp.Sign(claims(map[string]interface{}{
+			"aud": []string{"api", whoauth2test.ClientID}})), true},
+		{"matching azp", idp.Sign(claims(map[string]interface{}{
+			"azp": whoauth2test.ClientID})), true},
+		{"within clock skew", idp.Sign(claims(map[string]interface{}{
+			"exp": now.Add(-10 * time.Second).Unix()})), true},
+		{"tampered payload", tamper(idp.Sign(claims(nil))), false},
+		{"unknown key", other.Sign(claims(nil)), false},
+		{"malformed", "not.a.jwt", false},
+		{"wrong issuer", idp.Sign(claims(map[string]interface{}{
+			"iss": other.URL})), false},
+		{"wrong audience", idp.Sign(claims(map[string]interface{}{
+			"aud": "someone-else"})), false},
+		{"no audience", idp.Sign(claims(map[string]interface{}{
+			"aud": nil})), false},
+		{"other azp", idp.Sign(claims(map[string]interface{}{
+			"azp": "someone-else"})), false},
+		{"expired", idp.Sign(claims(map[string]interface{}{
+			"exp": now.Add(-time.Hour).Unix()})), false},
+		{"no expiry", idp.Sign(claims(map[string]interface{}{
+			"exp": nil})), false},
+		{"issued in the future", idp.Sign(claims(map[string]interface{}{
+			"iat": now.Add(time.Hour).Unix()})), false},
+	} {
+		got, err := oidc.Verify(context.Background(), whoauth2test.ClientID,
+			test.token)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got.Subject != "alice" {
+			t.Errorf("%s: got subject %#v", test.name, got.Subject)
+		}
+	}
+}
+
+func TestOIDCVerifyCheckIssuer(t *testing.T) {
+	idp := whoauth2test.NewServer()
+	defer idp.Close()
+
+	oidc := whoauth2.NewOIDC("https://issuer.example.com", idp.URL+"/jwks")
+	oidc.CheckIssuer = func(ctx context.Context,
+		claims *whoauth2.Claims) error {
+		if claims.Issuer != "https://tenant.example.com" {
+			return whoauth2.IDTokenError.New("unexpected issuer")
+		}
+		return nil
+	}
+	sign := func(issuer string) string {
+		return idp.Sign(map[string]interface{}{
+			"iss": issuer,
+			"sub": "alice",
+			"aud": whoauth2test.ClientID,
+			"exp": time.Now().Add(time.Hour).Unix()})
+	}
+
+	_, err := oidc.Verify(context.Background(), whoauth2test.ClientID,
+		sign("https://tenant.example.com"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = oidc.Verify(context.Background(), whoauth2test.ClientID,
+		sign("https://issuer.example.com"))
+	if err == nil {
+		t.Fatalf("expected CheckIssuer to reject the issuer")
+	}
+}
+
+// signEC signs claims as a JWT with key, using alg and hash.
+func signEC(t *testing.T, key *ecdsa.PrivateKey, alg string, hash crypto.Hash,
+	claims map[string]interface{}) string {
+	encode := func(val interface{}) string {
+		data, err := json.Marshal(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": alg}) + "." +
+		encode(claims)
+	h := hash.New()
+	h.Write([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerifyEC(t *testing.T) {
+	type ecKey struct {
+		alg  string
+		crv  string
+		hash crypto.Hash
+		key  *ecdsa.PrivateKey
+	}
+	var keys []*ecKey
+	for _, k := range []*ecKey{
+		{alg: "ES256", crv: "P-256", hash: crypto.SHA256},
+		{alg: "ES384", crv: "P-384", hash: crypto.SHA384},
+		{alg: "ES512", crv: "P-521", hash: crypto.SHA512},
+	} {
+		curve := map[string]elliptic.Curve{"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.crv]
+		var err error
+		k.key, err = ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+
+	jwks := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var set []map[string]string
+			for _, k := range keys {
+				size := (k.key.Curve.Params().BitSize + 7) / 8
+				x := make([]byte, size)
+				y := make([]byte, size)
+				k.key.X.FillBytes(x)
+				k.key.Y.FillBytes(y)
+				set = append(set, map[string]string{
+					"kty": "EC",
+					"kid": k.alg,
+					"crv": k.crv,
+					"x":   base64.RawURLEncoding.EncodeToString(x),
+					"y":   base64.RawURLEncoding.EncodeToString(y)})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+		}))
+	defer jwks.Close()
+
+	oidc := whoauth2.NewOIDC("https://issuer.example.com", jwks.URL)
+	claims := map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"sub": "alice",
+		"aud": whoauth2test.ClientID,
+		"exp": time.Now().Add(time.Hour).Unix()}
+	for _, k := range keys {
+		got, err := oidc.Verify(context.Background(), whoauth2test.ClientID,
+			signEC(t, k.key, k.alg, k.hash, claims))
+		if err != nil || got.Subject != "alice" {
+			t.Errorf("%s: got %+v, %v", k.alg, got, err)
+		}
+		// a signature from another key of the same size doesn't pass.
+		other, err := ecdsa.GenerateKey(k.key.Curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = oidc.Verify(context.Background(), whoauth2test.ClientID,
+			signEC(t, other, k.alg, k.hash, claims))
+		if err == nil {
+			t.Errorf("%s: forged signature verified", k.alg)
+		}
+	}
+}
+
+func TestEnableOIDC(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	app.mux.HandleFunc("/claims", func(w http.ResponseWriter, r *http.Request) {
+		claims, err := app.handler.Claims(whcompat.Context(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if claims == nil {
+			fmt.Fprint(w, "no claims")
+			return
+		}
+		fmt.Fprintf(w, "%s %s", claims.Issuer, claims.Subject)
+	})
+
+	// start from a plain OAuth2 provider and discover the rest.
+	p := app.handler.Provider()
+	p.Endpoint = oauth2.Endpoint{}
+	p.Scopes = []string{"email"}
+	p.OIDC = nil
+	p.FetchUserInfo = nil
+	err := p.EnableOIDC(context.Background(), idp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Endpoint.AuthURL != idp.URL+"/authorize" ||
+		p.Endpoint.TokenURL != idp.URL+"/token" || p.OIDC == nil ||
+		p.FetchUserInfo == nil ||
+		!reflect.DeepEqual(p.Scopes, []string{"openid", "email"}) {
+		t.Fatalf("got provider %+v", p)
+	}
+
+	user := idp.User("")
+	body, _, err := app.get(user, "/claims")
+	if err != nil || body != "no claims" {
+		t.Fatalf("logged out: got %#v, %v", body, err)
+	}
+	resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	body, _, err = app.get(user, "/claims")
+	if err != nil || body != idp.URL+" alice" {
+		t.Fatalf("logged in: got %#v, %v", body, err)
+	}
+}
+
+func TestGroupClaims(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+	app.group.SetIdentityStore(nil)
+	app.mux.HandleFunc("/claims", func(w http.ResponseWriter, r *http.Request) {
+		claims, err := app.group.Claims(whcompat.Context(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var logins []string
+		for name, c := range claims {
+			logins = append(logins, name+" "+c.Subject)
+		}
+		sort.Strings(logins)
+		fmt.Fprint(w, strings.Join(logins, ", "))
+	})
+
+	user := app.user()
+	for _, step := range []struct {
+		provider string
+		subject  string
+		want     string
+	}{
+		{"", "", ""},
+		{"a", "alice", "a alice"},
+		{"b", "bob", "a alice, b bob"},
+	} {
+		if step.provider != "" {
+			_, err := app.login(t, user, step.provider, step.subject)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		body, _, err := fetch(user.Client, app.URL+"/claims")
+		if err != nil || body != step.want {
+			t.Fatalf("got %#v, %v", body, err)
+		}
+	}
+}
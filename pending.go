@@ -0,0 +1,115 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"encoding/gob"
+	"time"
+
+	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+func init() {
+	gob.Register(pendingLogins{})
+}
+
+var (
+	// StateExpired is the error class for callbacks that arrive after the
+	// login's state has expired. See SetStateTTL.
+	StateExpired = wherr.BadRequest.NewClass("login state expired")
+
+	// StateReused is the error class for callbacks whose state was already
+	// used to finish a login, such as a replayed callback URL.
+	StateReused = wherr.BadRequest.NewClass("login state already used")
+)
+
+const (
+	// maxPendingLogins bounds how many logins a session may have in flight,
+	// so a session can't grow without limit. The oldest is dropped first.
+	maxPendingLogins = 8
+
+	// DefaultStateTTL is how long a user has to come back from the provider
+	// unless changed with SetStateTTL.
+	DefaultStateTTL = 10 * time.Minute
+)
+
+// pendingLogin is what the callback needs to finish a login that was
+// started by the login handler. Once used, the entry is kept with Used set
+// until it expires so replays can be told apart from forgeries.
+type pendingLogin struct {
+	RedirectTo string
+	Verifier   string
+	Nonce      string
+	Scopes     []string
+	Attach     bool
+	Created    time.Time
+	Used       bool
+}
+
+// pendingLogins holds the logins a session has in flight, keyed by state, so
+// logins started in different tabs don't clobber each other.
+type pendingLogins map[string]*pendingLogin
+
+func loadPendingLogins(session *whsess.Session) pendingLogins {
+	pending, ok := session.Values["_pending"].(pendingLogins)
+	if !ok || pending == nil {
+		pending = pendingLogins{}
+		session.Values["_pending"] = pending
+	}
+	return pending
+}
+
+// prune drops expired logins, and then the oldest ones until there is room
+// for one more.
+func (p pendingLogins) prune(now time.Time, ttl time.Duration) {
+	for state, login := range p {
+		if now.Sub(login.Created) > ttl {
+			delete(p, state)
+		}
+	}
+	for len(p) >= maxPendingLogins {
+		var oldest string
+		for state, login := range p {
+			if oldest == "" || login.Created.Before(p[oldest].Created) {
+				oldest = state
+			}
+		}
+		delete(p, oldest)
+	}
+}
+
+// add records a new login under state.
+func (p pendingLogins) add(state string, login *pendingLogin,
+	ttl time.Duration) {
+	p.prune(login.Created, ttl)
+	p[state] = login
+}
+
+// has returns whether state belongs to a login of the session, whether or
+// not it is still usable.
+func (p pendingLogins) has(state string) bool {
+	_, exists := p[state]
+	return exists
+}
+
+// take returns the login for state and marks it used. Unknown states are
+// reported as CSRFDetected errors, expired ones as StateExpired and used
+// ones as StateReused.
+func (p pendingLogins) take(state string, ttl time.Duration) (
+	*pendingLogin, error) {
+	login, exists := p[state]
+	if !exists {
+		return nil, CSRFDetected.New("unknown state")
+	}
+	if time.Since(login.Created) > ttl {
+		delete(p, state)
+		return nil, StateExpired.New("login started more than %s ago", ttl)
+	}
+	if login.Used {
+		return nil, StateReused.New("callback replayed")
+	}
+	p[state] = &pendingLogin{Created: login.Created, Used: true}
+	return login, nil
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPendingLoginsTake(t *testing.T) {
+	p := pendingLogins{}
+	p.add("state", &pendingLogin{Created: time.Now()}, time.Minute)
+
+	if _, err := p.take("other", time.Minute); !CSRFDetected.Contains(err) {
+		t.Fatalf("unknown state: got %v", err)
+	}
+	if _, err := p.take("state", time.Minute); err != nil {
+		t.Fatalf("first take: %v", err)
+	}
+	if _, err := p.take("state", time.Minute); !StateReused.Contains(err) {
+		t.Fatalf("second take: got %v", err)
+	}
+
+	p.add("old", &pendingLogin{Created: time.Now().Add(-2 * time.Minute)},
+		time.Hour)
+	if _, err := p.take("old", time.Minute); !StateExpired.Contains(err) {
+		t.Fatalf("expired take: got %v", err)
+	}
+	if _, exists := p["old"]; exists {
+		t.Fatalf("expired login kept")
+	}
+}
+
+func TestPendingLoginsPrune(t *testing.T) {
+	p := pendingLogins{}
+	start := time.Now()
+	for i := 0; i < 2*maxPendingLogins; i++ {
+		p.add(fmt.Sprint(i), &pendingLogin{
+			Created: start.Add(time.Duration(i) * time.Second)}, time.Hour)
+	}
+	if len(p) != maxPendingLogins {
+		t.Fatalf("got %d pending logins", len(p))
+	}
+	if _, exists := p[fmt.Sprint(2*maxPendingLogins-1)]; !exists {
+		t.Fatalf("newest login dropped")
+	}
+	if _, exists := p["0"]; exists {
+		t.Fatalf("oldest login kept")
+	}
+
+	p.add("new", &pendingLogin{Created: start.Add(3 * time.Hour)}, time.Hour)
+	if len(p) != 1 {
+		t.Fatalf("expired logins kept: %d", len(p))
+	}
+}
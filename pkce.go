@@ -0,0 +1,38 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+
+	"golang.org/x/oauth2"
+)
+
+// newCodeVerifier returns a fresh RFC 7636 code verifier. 32 random bytes
+// encode to 43 characters, the minimum length the RFC allows.
+func newCodeVerifier() string {
+	var p [32]byte
+	_, err := rand.Read(p[:])
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(p[:])
+}
+
+// codeChallengeOptions returns the AuthCodeURL options that send the S256
+// code challenge for verifier.
+func codeChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	sum := sha256.Sum256([]byte(verifier))
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge",
+			base64.RawURLEncoding.EncodeToString(sum[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256")}
+}
+
+// codeVerifierOption returns the Exchange option that sends verifier.
+func codeVerifierOption(verifier string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("code_verifier", verifier)
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// the example from RFC 7636, appendix B.
+	conf := oauth2.Config{Endpoint: oauth2.Endpoint{
+		AuthURL: "https://provider.example.com/authorize"}}
+	u, err := url.Parse(conf.AuthCodeURL("state", codeChallengeOptions(
+		"dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if got := q.Get("code_challenge"); got !=
+		"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("got code_challenge %#v", got)
+	}
+	if got := q.Get("code_challenge_method"); got != "S256" {
+		t.Errorf("got code_challenge_method %#v", got)
+	}
+}
+
+func TestNewCodeVerifier(t *testing.T) {
+	a, b := newCodeVerifier(), newCodeVerifier()
+	if len(a) < 43 || len(a) > 128 {
+		t.Errorf("verifier length %d out of range", len(a))
+	}
+	if a == b {
+		t.Errorf("verifiers repeat")
+	}
+}
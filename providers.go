@@ -4,6 +4,10 @@
 package whoauth2
 
 import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/facebook"
 	"golang.org/x/oauth2/github"
@@ -17,40 +21,166 @@ type Config oauth2.Config
 type Provider struct {
 	Name string
 	oauth2.Config
+
+	// DisablePKCE turns off RFC 7636 proof keys for this provider. PKCE is
+	// used by default; only set this for identity providers that reject the
+	// code_challenge parameters.
+	DisablePKCE bool
+
+	// OIDC, if set, puts the provider in OpenID Connect mode. See EnableOIDC.
+	OIDC *OIDC
+
+	// FetchUserInfo, if set, is used right after login to look up the user's
+	// profile, which is then kept in the session. Logins still succeed when it
+	// fails; see UserInfo and Hooks.OnUserInfoError.
+	FetchUserInfo UserInfoFetcher
+
+	// Revoke, if set, is used on logout to invalidate the user's tokens at
+	// the provider.
+	Revoke Revoker
+
+	// IntrospectionURL is the provider's RFC 7662 token introspection
+	// endpoint, if it has one. See IntrospectionValidator.
+	IntrospectionURL string
+
+	// DeviceAuthURL is the provider's RFC 8628 device authorization
+	// endpoint, if it has one. See DeviceLogin.
+	DeviceAuthURL string
+
+	// IncludeGrantedScopes adds include_granted_scopes=true to login
+	// requests, so that tokens from incremental logins (see RequireScopes)
+	// also cover the scopes granted before, as Google supports.
+	IncludeGrantedScopes bool
+
+	// AuthCodeOptions are added to every login request.
+	AuthCodeOptions []oauth2.AuthCodeOption
+
+	// ClientSecretSource, if set, is called for the client secret whenever
+	// one is needed, for providers like Apple whose secrets are short-lived
+	// and have to be minted. It overrides ClientSecret.
+	ClientSecretSource func(ctx context.Context) (string, error)
+
+	// UserInfoFromCallback, if set, is used instead of FetchUserInfo, for
+	// providers that send the profile along with the callback instead of
+	// offering an endpoint for it. claims is nil unless the provider is in
+	// OIDC mode.
+	UserInfoFromCallback func(r *http.Request, claims *Claims) (*UserInfo,
+		error)
+}
+
+// withSecret returns p, or a copy of p with the secret from
+// ClientSecretSource if it has one.
+func (p *Provider) withSecret(ctx context.Context) (*Provider, error) {
+	if p.ClientSecretSource == nil {
+		return p, nil
+	}
+	secret, err := p.ClientSecretSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	copy := *p
+	copy.ClientSecret = secret
+	return &copy, nil
 }
 
+// Github returns a provider for github.com. If conf has its own Endpoint, no
+// profile is fetched, tokens aren't revoked and the device flow isn't
+// available, since the other URLs aren't known; use GithubEnterprise for
+// GitHub Enterprise Server instead.
 func Github(conf Config) *Provider {
+	p := &Provider{Name: "github"}
 	if conf.Endpoint.AuthURL == "" {
 		conf.Endpoint = github.Endpoint
+		p.FetchUserInfo = GithubUserInfo("https://api.github.com")
+		p.Revoke = GithubRevoker("https://api.github.com")
+		p.DeviceAuthURL = "https://github.com/login/device/code"
+	}
+	p.Config = oauth2.Config(conf)
+	return p
+}
+
+// GithubEnterprise returns a provider for the GitHub Enterprise Server at
+// base_url, such as https://github.example.com.
+func GithubEnterprise(conf Config, base_url string) *Provider {
+	base_url = strings.TrimRight(base_url, "/")
+	if conf.Endpoint.AuthURL == "" {
+		conf.Endpoint = oauth2.Endpoint{
+			AuthURL:  base_url + "/login/oauth/authorize",
+			TokenURL: base_url + "/login/oauth/access_token"}
+	}
+	return &Provider{
+		Name:          "github-enterprise",
+		Config:        oauth2.Config(conf),
+		FetchUserInfo: GithubUserInfo(base_url + "/api/v3"),
+		Revoke:        GithubRevoker(base_url + "/api/v3"),
+		DeviceAuthURL: base_url + "/login/device/code"}
+}
+
+// GitLab returns a provider for the GitLab instance at base_url, such as
+// https://gitlab.com or a self-managed installation. The read_user scope is
+// requested unless conf has scopes.
+func GitLab(conf Config, base_url string) *Provider {
+	base_url = strings.TrimRight(base_url, "/")
+	if conf.Endpoint.AuthURL == "" {
+		conf.Endpoint = oauth2.Endpoint{
+			AuthURL:  base_url + "/oauth/authorize",
+			TokenURL: base_url + "/oauth/token"}
+	}
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"read_user"}
 	}
 	return &Provider{
-		Name:   "github",
-		Config: oauth2.Config(conf)}
+		Name:             "gitlab",
+		Config:           oauth2.Config(conf),
+		FetchUserInfo:    GitLabUserInfo(base_url + "/api/v4"),
+		Revoke:           RFC7009Revoker(base_url + "/oauth/revoke"),
+		IntrospectionURL: base_url + "/oauth/introspect",
+		DeviceAuthURL:    base_url + "/oauth/authorize_device"}
+}
+
+// Gitea returns a provider for the Gitea or Forgejo instance at base_url,
+// such as https://codeberg.org.
+func Gitea(conf Config, base_url string) *Provider {
+	base_url = strings.TrimRight(base_url, "/")
+	if conf.Endpoint.AuthURL == "" {
+		conf.Endpoint = oauth2.Endpoint{
+			AuthURL:  base_url + "/login/oauth/authorize",
+			TokenURL: base_url + "/login/oauth/access_token"}
+	}
+	return &Provider{
+		Name:          "gitea",
+		Config:        oauth2.Config(conf),
+		FetchUserInfo: GiteaUserInfo(base_url + "/api/v1")}
 }
 
 func Google(conf Config) *Provider {
+	p := &Provider{Name: "google", IncludeGrantedScopes: true}
 	if conf.Endpoint.AuthURL == "" {
 		conf.Endpoint = google.Endpoint
+		p.FetchUserInfo = GoogleUserInfo()
+		p.Revoke = GoogleRevoker()
+		p.DeviceAuthURL = "https://oauth2.googleapis.com/device/code"
 	}
-	return &Provider{
-		Name:   "google",
-		Config: oauth2.Config(conf)}
+	p.Config = oauth2.Config(conf)
+	return p
 }
 
 func Facebook(conf Config) *Provider {
+	p := &Provider{Name: "facebook"}
 	if conf.Endpoint.AuthURL == "" {
 		conf.Endpoint = facebook.Endpoint
+		p.FetchUserInfo = FacebookUserInfo("https://graph.facebook.com")
 	}
-	return &Provider{
-		Name:   "facebook",
-		Config: oauth2.Config(conf)}
+	p.Config = oauth2.Config(conf)
+	return p
 }
 
 func LinkedIn(conf Config) *Provider {
+	p := &Provider{Name: "linkedin"}
 	if conf.Endpoint.AuthURL == "" {
 		conf.Endpoint = linkedin.Endpoint
+		p.FetchUserInfo = LinkedInUserInfo()
 	}
-	return &Provider{
-		Name:   "linkedin",
-		Config: oauth2.Config(conf)}
+	p.Config = oauth2.Config(conf)
+	return p
 }
@@ -0,0 +1,175 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// forgeServer is a stand-in for a self-hosted forge. It issues the token
+// "token" for the code "code", serves profile at every API's /user, and
+// records the requests it gets.
+type forgeServer struct {
+	*httptest.Server
+	profile string
+
+	mtx      sync.Mutex
+	requests []string
+}
+
+func newForgeServer(profile string) *forgeServer {
+	s := &forgeServer{profile: profile}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *forgeServer) serve(w http.ResponseWriter, r *http.Request) {
+	user, pass, _ := r.BasicAuth()
+	r.ParseForm()
+	s.mtx.Lock()
+	s.requests = append(s.requests, fmt.Sprintf("%s %s %s:%s", r.Method,
+		r.URL.Path, user, pass))
+	s.mtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/login/oauth/access_token", "/oauth/token":
+		if r.FormValue("code") != "code" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "token", "token_type": "bearer"}`)
+	case "/api/v3/user", "/api/v4/user", "/api/v1/user":
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, `{}`, http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, s.profile)
+	case "/api/v3/applications/client/token":
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Method != "DELETE" || body.AccessToken != "token" {
+			http.Error(w, `{}`, http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "/oauth/revoke":
+		if r.FormValue("token") != "token" {
+			http.Error(w, `{}`, http.StatusBadRequest)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *forgeServer) lastRequest() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.requests) == 0 {
+		return ""
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+func TestForgeProviders(t *testing.T) {
+	conf := Config{ClientID: "client", ClientSecret: "secret"}
+	for _, test := range []struct {
+		name    string
+		make    func(base_url string) *Provider
+		auth    string
+		profile string
+		want    UserInfo
+		revoke  string
+	}{
+		{"github enterprise", func(base_url string) *Provider {
+			return GithubEnterprise(conf, base_url+"/")
+		}, "/login/oauth/authorize",
+			`{"id": 1, "login": "octocat", "email": "octocat@example.com"}`,
+			UserInfo{ID: "1", Name: "octocat", Email: "octocat@example.com"},
+			"DELETE /api/v3/applications/client/token client:secret"},
+		{"gitlab", func(base_url string) *Provider {
+			return GitLab(conf, base_url)
+		}, "/oauth/authorize",
+			`{"id": 2, "username": "tanuki", "email": "tanuki@example.com"}`,
+			UserInfo{ID: "2", Name: "tanuki", Email: "tanuki@example.com"},
+			"POST /oauth/revoke client:secret"},
+		{"gitea", func(base_url string) *Provider {
+			return Gitea(conf, base_url)
+		}, "/login/oauth/authorize",
+			`{"id": 3, "login": "tea", "full_name": "Tea Cup"}`,
+			UserInfo{ID: "3", Name: "Tea Cup"}, ""},
+	} {
+		server := newForgeServer(test.profile)
+		p := test.make(server.URL)
+		ctx := context.Background()
+
+		if p.Endpoint.AuthURL != server.URL+test.auth {
+			t.Errorf("%s: got auth url %s", test.name, p.Endpoint.AuthURL)
+		}
+		token, err := p.Exchange(ctx, "code")
+		if err != nil {
+			t.Errorf("%s: exchange: %v", test.name, err)
+			server.Close()
+			continue
+		}
+		info, err := p.FetchUserInfo(ctx,
+			oauth2.NewClient(ctx, oauth2.StaticTokenSource(token)))
+		if err != nil {
+			t.Errorf("%s: user info: %v", test.name, err)
+		} else if *info != test.want {
+			t.Errorf("%s: got user info %+v", test.name, info)
+		}
+
+		if test.revoke == "" {
+			if p.Revoke != nil {
+				t.Errorf("%s: unexpected Revoke", test.name)
+			}
+		} else if err := p.Revoke(ctx, p, token); err != nil {
+			t.Errorf("%s: revoke: %v", test.name, err)
+		} else if got := server.lastRequest(); got != test.revoke {
+			t.Errorf("%s: revoke sent %#v", test.name, got)
+		}
+		server.Close()
+	}
+}
+
+func TestCustomEndpoint(t *testing.T) {
+	custom := Config{Endpoint: oauth2.Endpoint{
+		AuthURL:  "https://idp.example.com/authorize",
+		TokenURL: "https://idp.example.com/token"}}
+	for _, test := range []struct {
+		name   string
+		make   func(conf Config) *Provider
+		revoke bool
+		device bool
+	}{
+		{"github", Github, true, true},
+		{"google", Google, true, true},
+		{"facebook", Facebook, false, false},
+		{"linkedin", LinkedIn, false, false},
+	} {
+		p := test.make(Config{})
+		if p.FetchUserInfo == nil || (p.Revoke != nil) != test.revoke ||
+			(p.DeviceAuthURL != "") != test.device {
+			t.Errorf("%s: got default provider %+v", test.name, p)
+		}
+		// whatever is behind a custom endpoint doesn't serve the public API.
+		p = test.make(custom)
+		if p.FetchUserInfo != nil || p.Revoke != nil || p.DeviceAuthURL != "" {
+			t.Errorf("%s: custom endpoint provider uses the public API: %+v",
+				test.name, p)
+		}
+	}
+}
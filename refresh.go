@@ -0,0 +1,101 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// refreshRaceWindow is how long a refreshed token is handed to requests
+	// that still show up with the refresh token it replaced. It only needs to
+	// cover requests that raced the session update, since anything later
+	// presenting the old refresh token is a replay the provider should see.
+	refreshRaceWindow = 5 * time.Second
+
+	// refreshRejectedTTL is how long a refresh token the provider turned
+	// down is remembered, so that requests from a session that can't be
+	// updated don't each ask the provider again.
+	refreshRejectedTTL = time.Minute
+)
+
+// refresher makes sure that concurrent requests holding the same expired
+// token share a single refresh instead of each hitting the provider.
+type refresher struct {
+	mtx     sync.Mutex
+	pending map[string]*refreshCall
+	recent  map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done    chan struct{}
+	token   *oauth2.Token
+	err     error
+	expires time.Time
+}
+
+// refresh returns a fresh token for the expired token using provider's
+// token endpoint.
+func (r *refresher) refresh(ctx context.Context, provider *Provider,
+	token *oauth2.Token) (*oauth2.Token, error) {
+	key := token.RefreshToken
+	now := time.Now()
+
+	r.mtx.Lock()
+	if r.pending == nil {
+		r.pending = make(map[string]*refreshCall)
+		r.recent = make(map[string]*refreshCall)
+	}
+	for old_key, call := range r.recent {
+		if now.After(call.expires) {
+			delete(r.recent, old_key)
+		}
+	}
+	if call, exists := r.recent[key]; exists {
+		r.mtx.Unlock()
+		return call.token, call.err
+	}
+	if call, exists := r.pending[key]; exists {
+		r.mtx.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	r.pending[key] = call
+	r.mtx.Unlock()
+
+	provider, call.err = provider.withSecret(ctx)
+	if call.err == nil {
+		call.token, call.err = provider.TokenSource(ctx,
+			&oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+	}
+
+	r.mtx.Lock()
+	delete(r.pending, key)
+	switch {
+	case call.err == nil:
+		call.expires = time.Now().Add(refreshRaceWindow)
+		r.recent[key] = call
+	case refreshRejected(call.err):
+		call.expires = time.Now().Add(refreshRejectedTTL)
+		r.recent[key] = call
+	}
+	r.mtx.Unlock()
+	close(call.done)
+
+	return call.token, call.err
+}
+
+// refreshRejected returns whether err means the provider turned the refresh
+// token down, as opposed to the token endpoint being unreachable or failing.
+// Other client errors, such as rate limiting or a bad client secret, aren't
+// the user's doing, so they don't count.
+func refreshRejected(err error) bool {
+	e, ok := err.(*oauth2.RetrieveError)
+	return ok && e.ErrorCode == "invalid_grant"
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// Revoker invalidates token at the provider, so it stops working even if
+// someone kept a copy.
+type Revoker func(ctx context.Context, provider *Provider,
+	token *oauth2.Token) error
+
+// RevocationPolicy decides what happens when revoking a token during logout
+// fails. Returning nil lets the logout go ahead, returning an error aborts
+// it and leaves the session alone.
+type RevocationPolicy func(ctx context.Context, provider *Provider,
+	err error) error
+
+// BestEffortRevocation is a RevocationPolicy that logs the user out even if
+// the token couldn't be revoked. If report is not nil it is called with each
+// failure.
+func BestEffortRevocation(report func(ctx context.Context,
+	provider *Provider, err error)) RevocationPolicy {
+	return func(ctx context.Context, provider *Provider, err error) error {
+		if report != nil {
+			report(ctx, provider, err)
+		}
+		return nil
+	}
+}
+
+// StrictRevocation is a RevocationPolicy that fails the logout if the token
+// couldn't be revoked.
+func StrictRevocation(ctx context.Context, provider *Provider,
+	err error) error {
+	return err
+}
+
+// RFC7009Revoker returns a Revoker for an RFC 7009 revocation endpoint. The
+// refresh token is revoked if there is one, which also invalidates its access
+// tokens, otherwise the access token is.
+func RFC7009Revoker(revocation_url string) Revoker {
+	return func(ctx context.Context, provider *Provider,
+		token *oauth2.Token) error {
+		vals := url.Values{}
+		if token.RefreshToken != "" {
+			vals.Set("token", token.RefreshToken)
+			vals.Set("token_type_hint", "refresh_token")
+		} else {
+			vals.Set("token", token.AccessToken)
+			vals.Set("token_type_hint", "access_token")
+		}
+		inParams := provider.Endpoint.AuthStyle == oauth2.AuthStyleInParams
+		if inParams {
+			vals.Set("client_id", provider.ClientID)
+			if provider.ClientSecret != "" {
+				vals.Set("client_secret", provider.ClientSecret)
+			}
+		}
+		req, err := http.NewRequest("POST", revocation_url,
+			strings.NewReader(vals.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if !inParams {
+			req.SetBasicAuth(url.QueryEscape(provider.ClientID),
+				url.QueryEscape(provider.ClientSecret))
+		}
+		return doRevoke(ctx, req)
+	}
+}
+
+// GoogleRevoker returns a Revoker for Google's revocation endpoint.
+func GoogleRevoker() Revoker {
+	return RFC7009Revoker("https://oauth2.googleapis.com/revoke")
+}
+
+// GithubRevoker returns a Revoker that deletes the user's access token
+// through the Github API at api_url, usually https://api.github.com. The
+// user's authorization of the OAuth app, and any other tokens it has, are
+// left alone.
+func GithubRevoker(api_url string) Revoker {
+	api_url = strings.TrimRight(api_url, "/")
+	return func(ctx context.Context, provider *Provider,
+		token *oauth2.Token) error {
+		body, err := json.Marshal(map[string]string{
+			"access_token": token.AccessToken})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("DELETE", api_url+"/applications/"+
+			url.PathEscape(provider.ClientID)+"/token", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.SetBasicAuth(provider.ClientID, provider.ClientSecret)
+		return doRevoke(ctx, req)
+	}
+}
+
+func doRevoke(ctx context.Context, req *http.Request) error {
+	resp, err := contextClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("revoking token at %s: %s: %s", req.URL.Host,
+			resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"net/http"
+	"strings"
+
+	"gopkg.in/webhelp.v1/whcompat"
+	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whredir"
+	"gopkg.in/webhelp.v1/whroute"
+)
+
+var (
+	// InsufficientScope is the error class for bearer tokens that were
+	// granted fewer scopes than an endpoint requires.
+	InsufficientScope = wherr.Forbidden.NewClass("insufficient scope")
+
+	// ScopeNotAllowed is the error class for logins asking for scopes that
+	// no RequireScopes wrapper of the handler requires.
+	ScopeNotAllowed = wherr.BadRequest.NewClass("scope not allowed")
+)
+
+// RequireScopes is like LoginRequired, but also requires that the user
+// granted every scope in scopes. Users that haven't are sent back through
+// login asking for the scopes they already granted plus the missing ones,
+// so scopes can be requested incrementally as users reach the features that
+// need them. Requests authenticated by BearerRequired that lack a scope get a
+// 403 JSON response instead.
+//
+// The login handler only asks for extra scopes that the provider is
+// configured with or some RequireScopes wrapper requires, so wrap handlers
+// before serving requests.
+func (o *ProviderHandler) RequireScopes(h http.Handler,
+	scopes ...string) http.Handler {
+	o.allowed_scopes = unionScopes(o.allowed_scopes, scopes)
+	return whroute.HandlerFunc(h,
+		func(w http.ResponseWriter, r *http.Request) {
+			r = withResponseWriter(r, w)
+			ctx := whcompat.Context(r)
+			if id, ok := o.bearerIdentity(ctx); ok {
+				if missing := missingScopes(id.Scopes, scopes); len(missing) > 0 {
+					w.Header().Set("WWW-Authenticate",
+						`Bearer error="insufficient_scope", scope="`+
+							strings.Join(scopes, " ")+`"`)
+					writeJSONError(w, InsufficientScope.New(
+						"missing %s", strings.Join(missing, " ")))
+					return
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+			session, err := o.Session(ctx)
+			if err != nil {
+				wherr.Handle(w, r, err)
+				return
+			}
+			token, err := o.token(ctx, session)
+			if err != nil {
+				wherr.Handle(w, r, err)
+				return
+			}
+			if token == nil ||
+				len(missingScopes(o.scopes(session), scopes)) > 0 {
+				login_url := o.loginURL(r.RequestURI, false, scopes, "")
+				if wantsJSON(r) {
+					loginRequiredJSON(w, login_url)
+					return
+				}
+				whredir.Redirect(w, r, login_url)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+}
+
+// missingScopes returns the scopes in required that aren't in granted.
+func missingScopes(granted, required []string) (missing []string) {
+	for _, scope := range required {
+		if !contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// checkScopes makes sure the extra scopes a login asks for are ones the
+// provider is configured with or a RequireScopes wrapper needs, so links to
+// the login handler can't make users grant arbitrary scopes.
+func (o *ProviderHandler) checkScopes(scopes []string) error {
+	allowed := unionScopes(o.provider.Scopes, o.allowed_scopes)
+	if missing := missingScopes(allowed, scopes); len(missing) > 0 {
+		return ScopeNotAllowed.New("%s", strings.Join(missing, " "))
+	}
+	return nil
+}
+
+// unionScopes returns every scope in lists, in order and without
+// duplicates.
+func unionScopes(lists ...[]string) (union []string) {
+	for _, list := range lists {
+		for _, scope := range list {
+			if !contains(union, scope) {
+				union = append(union, scope)
+			}
+		}
+	}
+	return union
+}
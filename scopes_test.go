@@ -0,0 +1,46 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMissingScopes(t *testing.T) {
+	for _, test := range []struct {
+		granted, required, missing []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a", "b"}, nil, nil},
+		{[]string{"a", "b"}, []string{"b", "a"}, nil},
+		{[]string{"a"}, []string{"a", "b", "c"}, []string{"b", "c"}},
+		{nil, []string{"a"}, []string{"a"}},
+	} {
+		got := missingScopes(test.granted, test.required)
+		if !reflect.DeepEqual(got, test.missing) {
+			t.Errorf("missingScopes(%v, %v): got %v, want %v", test.granted,
+				test.required, got, test.missing)
+		}
+	}
+}
+
+func TestUnionScopes(t *testing.T) {
+	for _, test := range []struct {
+		lists [][]string
+		union []string
+	}{
+		{nil, nil},
+		{[][]string{{"a", "b"}}, []string{"a", "b"}},
+		{[][]string{{"a", "b"}, nil, {"b", "c"}, {"a"}},
+			[]string{"a", "b", "c"}},
+		{[][]string{{"a", "a"}}, []string{"a"}},
+	} {
+		got := unionScopes(test.lists...)
+		if !reflect.DeepEqual(got, test.union) {
+			t.Errorf("unionScopes(%v): got %v, want %v", test.lists, got,
+				test.union)
+		}
+	}
+}
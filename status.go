@@ -0,0 +1,173 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/webhelp.v1/whcompat"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+// ProviderStatus describes the login state of a single provider. It is what
+// the /status endpoints return as JSON.
+type ProviderStatus struct {
+	Provider  string     `json:"provider"`
+	LoggedIn  bool       `json:"logged_in"`
+	Expiry    *time.Time `json:"expiry,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	LoginURL  string     `json:"login_url"`
+	LogoutURL string     `json:"logout_url"`
+}
+
+// GroupStatus describes the login state of every provider in a
+// ProviderGroup.
+type GroupStatus struct {
+	LoggedIn     bool                       `json:"logged_in"`
+	Providers    map[string]*ProviderStatus `json:"providers"`
+	LogoutAllURL string                     `json:"logout_all_url"`
+}
+
+// Status returns the login state for this provider. redirect_to is used for
+// the login and logout URLs.
+func (o *ProviderHandler) Status(ctx context.Context, redirect_to string) (
+	*ProviderStatus, error) {
+	session, err := o.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := o.token(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	status := &ProviderStatus{
+		Provider:  o.provider.Name,
+		LoggedIn:  token != nil,
+		LoginURL:  o.LoginURL(redirect_to, false),
+		LogoutURL: o.LogoutURL(redirect_to)}
+	if token != nil {
+		if !token.Expiry.IsZero() {
+			expiry := token.Expiry
+			status.Expiry = &expiry
+		}
+		status.Scopes = o.scopes(session)
+	}
+	return status, nil
+}
+
+// Status returns the login state for every provider. redirect_to is used for
+// the login and logout URLs.
+func (g *ProviderGroup) Status(ctx context.Context, redirect_to string) (
+	*GroupStatus, error) {
+	status := &GroupStatus{
+		Providers:    make(map[string]*ProviderStatus, len(g.handlers)),
+		LogoutAllURL: g.LogoutAllURL(redirect_to)}
+	var errs errors.ErrorGroup
+	for name, handler := range g.handlers {
+		provider_status, err := handler.Status(ctx, redirect_to)
+		errs.Add(err)
+		if err == nil {
+			status.Providers[name] = provider_status
+			status.LoggedIn = status.LoggedIn || provider_status.LoggedIn
+		}
+	}
+	return status, errs.Finalize()
+}
+
+// scopes returns the scopes recorded when the user logged in.
+func (o *ProviderHandler) scopes(session *whsess.Session) []string {
+	if scopes, ok := session.Values["_scopes"].([]string); ok {
+		return scopes
+	}
+	return o.provider.Scopes
+}
+
+// grantedScopes returns the requested scopes plus any others the provider
+// says it granted in the token response. Providers may name granted scopes
+// differently than they were asked for, such as Google answering email with
+// https://www.googleapis.com/auth/userinfo.email, so the requested scopes
+// are always kept. Otherwise RequireScopes would send users back to login
+// for them forever.
+func grantedScopes(token *oauth2.Token, requested []string) []string {
+	scope, _ := token.Extra("scope").(string)
+	// Github separates scopes with commas
+	scopes := strings.FieldsFunc(scope, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	return unionScopes(requested, scopes)
+}
+
+func (o *ProviderHandler) status(w http.ResponseWriter, r *http.Request) {
+	r = withResponseWriter(r, w)
+	status, err := o.Status(whcompat.Context(r), r.FormValue("redirect_to"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (g *ProviderGroup) status(w http.ResponseWriter, r *http.Request) {
+	r = withResponseWriter(r, w)
+	status, err := g.Status(whcompat.Context(r), r.FormValue("redirect_to"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// wantsJSON returns true if the request's Accept header asks for JSON.
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		media_type, _, err := mime.ParseMediaType(accept)
+		if err == nil && media_type == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// loginRequiredJSON answers an API request that needs a logged in user.
+func loginRequiredJSON(w http.ResponseWriter, login_url string) {
+	writeJSON(w, http.StatusUnauthorized, map[string]string{
+		"error":     "login_required",
+		"login_url": login_url})
+}
+
+// writeJSONError writes err as a JSON error response, with the status code
+// wherr.Handle would use.
+func writeJSONError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*AuthorizationError); ok {
+		writeJSON(w, errhttp.GetStatusCode(e.httpError(),
+			http.StatusInternalServerError), map[string]string{
+			"error":             e.Code,
+			"error_description": e.Description,
+			"error_uri":         e.URI})
+		return
+	}
+	code := errhttp.GetStatusCode(err, http.StatusInternalServerError)
+	error_code := ErrorServerError
+	if code < 500 {
+		error_code = ErrorInvalidRequest
+	}
+	writeJSON(w, code, map[string]string{
+		"error":             error_code,
+		"error_description": errhttp.GetErrorBody(err)})
+}
+
+func writeJSON(w http.ResponseWriter, code int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(val)
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+// getJSON fetches url with client and decodes the JSON response into val.
+func getJSON(client *http.Client, url string, val interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/json" ||
+		resp.Header.Get("Cache-Control") != "no-store" {
+		return fmt.Errorf("got %s with content type %#v", resp.Status,
+			resp.Header.Get("Content-Type"))
+	}
+	return json.NewDecoder(resp.Body).Decode(val)
+}
+
+func TestStatus(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	user := idp.User("")
+
+	var status whoauth2.ProviderStatus
+	err := getJSON(user.Client, app.URL+"/auth/status?redirect_to=/next",
+		&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := whoauth2.ProviderStatus{
+		Provider:  "test",
+		LoginURL:  app.handler.LoginURL("/next", false),
+		LogoutURL: app.handler.LogoutURL("/next")}
+	if !reflect.DeepEqual(status, want) {
+		t.Fatalf("logged out: got %+v", status)
+	}
+
+	resp, err := user.Login(app.URL + app.handler.LoginURL("/", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	status = whoauth2.ProviderStatus{}
+	err = getJSON(user.Client, app.URL+"/auth/status?redirect_to=/next",
+		&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.LoggedIn || status.Expiry == nil ||
+		!reflect.DeepEqual(status.Scopes,
+			[]string{"openid", "email", "profile"}) ||
+		status.LoginURL != want.LoginURL ||
+		status.LogoutURL != want.LogoutURL {
+		t.Fatalf("logged in: got %+v", status)
+	}
+}
+
+func TestGroupStatus(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+	user := app.user()
+
+	for _, logged_in := range []bool{false, true} {
+		if logged_in {
+			if _, err := app.login(t, user, "a", "alice"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var status whoauth2.GroupStatus
+		err := getJSON(user.Client, app.URL+"/auth/all/status", &status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.LoggedIn != logged_in || len(status.Providers) != 2 ||
+			status.LogoutAllURL != app.group.LogoutAllURL("") {
+			t.Fatalf("logged in %v: got %+v", logged_in, status)
+		}
+		for name, provider_status := range status.Providers {
+			if provider_status.Provider != name ||
+				provider_status.LoggedIn != (logged_in && name == "a") {
+				t.Errorf("logged in %v: got %s status %+v", logged_in, name,
+					provider_status)
+			}
+		}
+	}
+}
+
+func TestLoginRequiredJSON(t *testing.T) {
+	idp := whoauth2test.NewServer(whoauth2test.Identity{Subject: "alice"})
+	defer idp.Close()
+	app := newTestApp(idp)
+	defer app.Close()
+	app.mux.Handle("/private",
+		app.handler.LoginRequired(http.HandlerFunc(app.page)))
+	login_url := app.handler.LoginURL("/private", false)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	for _, test := range []struct {
+		accept string
+		json   bool
+	}{
+		{"", false},
+		{"text/html", false},
+		{"*/*", false},
+		{"application/jsonp", false},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"text/html, application/json;q=0.9", true},
+	} {
+		req, err := http.NewRequest("GET", app.URL+"/private", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]string
+		if test.json {
+			err = json.NewDecoder(resp.Body).Decode(&body)
+		}
+		resp.Body.Close()
+		if !test.json {
+			if resp.StatusCode/100 != 3 ||
+				resp.Header.Get("Location") != login_url {
+				t.Errorf("%#v: got %s to %#v", test.accept, resp.Status,
+					resp.Header.Get("Location"))
+			}
+			continue
+		}
+		if err != nil || resp.StatusCode != http.StatusUnauthorized ||
+			body["error"] != "login_required" ||
+			body["login_url"] != login_url {
+			t.Errorf("%#v: got %s %v, %v", test.accept, resp.Status, body,
+				err)
+		}
+	}
+}
+
+func TestGroupLoginRequiredJSON(t *testing.T) {
+	app := newGroupApp(t)
+	defer app.Close()
+	handler := app.group.LoginRequired(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}),
+		func(redirect_to string) string {
+			return "/choose?redirect_to=" + redirect_to
+		})
+
+	server := httptest.NewServer(whsess.HandlerWithStore(
+		whsess.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")),
+		handler))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/private", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized ||
+		body["error"] != "login_required" ||
+		body["login_url"] != "/choose?redirect_to=/private" {
+		t.Fatalf("got %s %v, %v", resp.Status, body, err)
+	}
+}
@@ -0,0 +1,471 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+// TokenStore keeps tokens outside of the session, so that large tokens don't
+// overflow cookie size limits and refresh tokens never reach the browser.
+// The session then only holds a random id that refers to the stored token.
+// The ID token and user info from the login are stored too, under a second
+// id. The data is encoded and is opaque to the store.
+type TokenStore interface {
+	// Get returns the data stored under id, or nil if there is none.
+	Get(ctx context.Context, id string) ([]byte, error)
+	Put(ctx context.Context, id string, data []byte) error
+	Delete(ctx context.Context, id string) error
+}
+
+// SetTokenStore makes the handler keep tokens, along with the ID tokens and
+// user info from logins, in store instead of in the session. Users that
+// logged in before the switch have to log in again.
+func (o *ProviderHandler) SetTokenStore(store TokenStore) {
+	o.store = store
+}
+
+// SetTokenEncryption makes the handler encrypt tokens with keys before they
+// are written to the session or the TokenStore. Tokens that were stored
+// unencrypted in the session are encrypted the next time it is saved.
+func (o *ProviderHandler) SetTokenEncryption(keys *KeyRing) {
+	o.keys = keys
+}
+
+// SetTokenEncryption sets the KeyRing of every provider's handler. See
+// (*ProviderHandler).SetTokenEncryption.
+func (g *ProviderGroup) SetTokenEncryption(keys *KeyRing) {
+	for _, handler := range g.handlers {
+		handler.SetTokenEncryption(keys)
+	}
+}
+
+// SetTokenStore sets the TokenStore of every provider's handler. See
+// (*ProviderHandler).SetTokenStore.
+func (g *ProviderGroup) SetTokenStore(store TokenStore) {
+	for _, handler := range g.handlers {
+		handler.SetTokenStore(store)
+	}
+}
+
+// storedToken returns the user's token, whether or not it is still valid.
+// Tokens that can't be decrypted, such as ones sealed with a key that has
+// since been dropped from the KeyRing, are deleted and treated as missing, so
+// the user just has to log in again.
+func (o *ProviderHandler) storedToken(ctx context.Context,
+	session *whsess.Session) (*oauth2.Token, error) {
+	var data []byte
+	if o.store == nil {
+		switch val := session.Values["_token"].(type) {
+		case *oauth2.Token:
+			if o.keys == nil {
+				return val, nil
+			}
+			// stored before encryption was turned on, so encrypt it now.
+			err := o.putToken(ctx, session, val)
+			if err != nil {
+				return nil, err
+			}
+			return val, o.saveResealed(ctx, session)
+		case []byte:
+			data = val
+		default:
+			return nil, nil
+		}
+	} else {
+		id, ok := session.Values["_token_ref"].(string)
+		if !ok {
+			return nil, nil
+		}
+		var err error
+		data, err = o.store.Get(ctx, id)
+		if err != nil || data == nil {
+			return nil, err
+		}
+	}
+
+	rotated := false
+	if o.keys != nil {
+		var err error
+		data, rotated, err = o.keys.open(data, []byte(o.session_namespace))
+		if err != nil {
+			return nil, o.dropToken(ctx, session)
+		}
+	}
+	var token oauth2.Token
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&token)
+	if err != nil {
+		return nil, o.dropToken(ctx, session)
+	}
+	if rotated {
+		err = o.putToken(ctx, session, &token)
+		if err == nil {
+			err = o.saveResealed(ctx, session)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+// saveResealed saves the session after a token in it was sealed again with
+// the primary key, if the request allows it. Otherwise the old key is still
+// needed until the session is next saved.
+func (o *ProviderHandler) saveResealed(ctx context.Context,
+	session *whsess.Session) error {
+	w, can_save := responseWriter(ctx)
+	if o.store != nil || !can_save {
+		return nil
+	}
+	return session.Save(ctx, w)
+}
+
+// putToken sets token as the user's token, encrypting it if the handler has
+// a KeyRing. The session still needs to be saved.
+func (o *ProviderHandler) putToken(ctx context.Context,
+	session *whsess.Session, token *oauth2.Token) error {
+	if o.store == nil && o.keys == nil {
+		session.Values["_token"] = token
+		return nil
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(token)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if o.keys != nil {
+		data = o.keys.seal(data, []byte(o.session_namespace))
+	}
+	if o.store == nil {
+		session.Values["_token"] = data
+		return nil
+	}
+	// a token kept in the session before the store was set must not outlive
+	// the one in the store.
+	delete(session.Values, "_token")
+	return o.store.Put(ctx, tokenRef(session), data)
+}
+
+// tokenRef returns the id the user's token is stored under, picking one if
+// the session doesn't have one yet.
+func tokenRef(session *whsess.Session) string {
+	id, ok := session.Values["_token_ref"].(string)
+	if !ok {
+		id = newState()
+		session.Values["_token_ref"] = id
+	}
+	return id
+}
+
+// loginInfoRef returns the id the ID token and user info that go with the
+// token stored under id are stored under.
+func loginInfoRef(id string) string {
+	return id + ".login"
+}
+
+// loginInfo is what the handler keeps about a login besides the token.
+type loginInfo struct {
+	IDToken  string
+	UserInfo *UserInfo
+}
+
+// storedLoginInfo returns the raw ID token and user info saved when the user
+// logged in, either of which may be empty. With a TokenStore they are kept in
+// the store next to the token, so that the session stays small.
+func (o *ProviderHandler) storedLoginInfo(ctx context.Context,
+	session *whsess.Session) (raw_id_token string, info *UserInfo,
+	err error) {
+	var data []byte
+	if id, ok := session.Values["_token_ref"].(string); ok && o.store != nil {
+		data, err = o.store.Get(ctx, loginInfoRef(id))
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if data == nil {
+		// logins from before the store kept login info still have it in the
+		// session.
+		raw_id_token, _ = session.Values["_id_token"].(string)
+		info, _ = session.Values["_userinfo"].(*UserInfo)
+		return raw_id_token, info, nil
+	}
+	rotated := false
+	if o.keys != nil {
+		data, rotated, err = o.keys.open(data, []byte(o.session_namespace))
+		if err != nil {
+			// like a token that can't be read, this is treated as missing.
+			return "", nil, nil
+		}
+	}
+	var login loginInfo
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&login)
+	if err != nil {
+		return "", nil, nil
+	}
+	if rotated {
+		err = o.putLoginInfo(ctx, session, login.IDToken, login.UserInfo)
+		if err == nil {
+			err = o.saveResealed(ctx, session)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return login.IDToken, login.UserInfo, nil
+}
+
+// putLoginInfo saves the raw ID token and user info for the user's login,
+// next to the token if the handler has a TokenStore. The session still needs
+// to be saved.
+func (o *ProviderHandler) putLoginInfo(ctx context.Context,
+	session *whsess.Session, raw_id_token string, info *UserInfo) error {
+	if o.store == nil {
+		setOrDelete(session, "_id_token", raw_id_token, raw_id_token != "")
+		setOrDelete(session, "_userinfo", info, info != nil)
+		return nil
+	}
+	delete(session.Values, "_id_token")
+	delete(session.Values, "_userinfo")
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(loginInfo{
+		IDToken:  raw_id_token,
+		UserInfo: info})
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if o.keys != nil {
+		data = o.keys.seal(data, []byte(o.session_namespace))
+	}
+	return o.store.Put(ctx, loginInfoRef(tokenRef(session)), data)
+}
+
+// dropToken forgets a token that can't be read. The session still needs to be
+// saved.
+func (o *ProviderHandler) dropToken(ctx context.Context,
+	session *whsess.Session) error {
+	err := o.deleteToken(ctx, session)
+	delete(session.Values, "_token")
+	delete(session.Values, "_token_ref")
+	return err
+}
+
+// deleteToken removes the user's token and login info from the token store,
+// if there is one. Clearing the session takes care of the rest.
+func (o *ProviderHandler) deleteToken(ctx context.Context,
+	session *whsess.Session) error {
+	if o.store == nil {
+		return nil
+	}
+	id, ok := session.Values["_token_ref"].(string)
+	if !ok {
+		return nil
+	}
+	err := o.store.Delete(ctx, id)
+	if ierr := o.store.Delete(ctx, loginInfoRef(id)); err == nil {
+		err = ierr
+	}
+	return err
+}
+
+// MemoryTokenStore is a TokenStore that keeps tokens in memory, so they are
+// lost when the process exits and aren't shared between processes.
+type MemoryTokenStore struct {
+	max_age time.Duration
+
+	mtx        sync.Mutex
+	entries    map[string]memoryTokenEntry
+	last_sweep time.Time
+}
+
+type memoryTokenEntry struct {
+	data    []byte
+	written time.Time
+}
+
+// NewMemoryTokenStore makes a MemoryTokenStore. Tokens that haven't been
+// written for max_age are dropped, so that abandoned sessions don't leak
+// memory. A max_age of 0 keeps tokens until they are deleted.
+func NewMemoryTokenStore(max_age time.Duration) *MemoryTokenStore {
+	return &MemoryTokenStore{
+		max_age: max_age,
+		entries: make(map[string]memoryTokenEntry)}
+}
+
+func (s *MemoryTokenStore) expired(entry memoryTokenEntry,
+	now time.Time) bool {
+	return s.max_age > 0 && now.Sub(entry.written) > s.max_age
+}
+
+// Get implements TokenStore
+func (s *MemoryTokenStore) Get(ctx context.Context, id string) ([]byte,
+	error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	entry, exists := s.entries[id]
+	if !exists || s.expired(entry, time.Now()) {
+		return nil, nil
+	}
+	return entry.data, nil
+}
+
+// Put implements TokenStore
+func (s *MemoryTokenStore) Put(ctx context.Context, id string,
+	data []byte) error {
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.max_age > 0 && now.Sub(s.last_sweep) >= tokenSweepInterval {
+		s.last_sweep = now
+		for other_id, entry := range s.entries {
+			if s.expired(entry, now) {
+				delete(s.entries, other_id)
+			}
+		}
+	}
+	s.entries[id] = memoryTokenEntry{
+		data:    append([]byte(nil), data...),
+		written: now}
+	return nil
+}
+
+// Delete implements TokenStore
+func (s *MemoryTokenStore) Delete(ctx context.Context, id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+// tokenSweepInterval is how often MemoryTokenStore and FileTokenStore look
+// for expired tokens to remove.
+const tokenSweepInterval = time.Hour
+
+// FileTokenStore is a TokenStore that keeps each token in its own file in a
+// directory. File names are hashes of the ids.
+type FileTokenStore struct {
+	dir     string
+	max_age time.Duration
+
+	mtx        sync.Mutex
+	last_sweep time.Time
+}
+
+// NewFileTokenStore makes a FileTokenStore in dir, creating it if needed.
+// The directory and the token files are only accessible by the current user.
+// Tokens that haven't been written for max_age are ignored and eventually
+// removed, so that abandoned sessions don't fill up the directory. A max_age
+// of 0 keeps tokens until they are deleted.
+func NewFileTokenStore(dir string, max_age time.Duration) (*FileTokenStore,
+	error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTokenStore{dir: dir, max_age: max_age}, nil
+}
+
+func (s *FileTokenStore) expired(info os.FileInfo, now time.Time) bool {
+	return s.max_age > 0 && now.Sub(info.ModTime()) > s.max_age
+}
+
+// sweep removes expired token files, and temporary files left behind by
+// failed writes, at most once every tokenSweepInterval.
+func (s *FileTokenStore) sweep(now time.Time) {
+	if s.max_age <= 0 {
+		return
+	}
+	s.mtx.Lock()
+	due := now.Sub(s.last_sweep) >= tokenSweepInterval
+	if due {
+		s.last_sweep = now
+	}
+	s.mtx.Unlock()
+	if !due {
+		return
+	}
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && s.expired(info, now) {
+			os.Remove(filepath.Join(s.dir, info.Name()))
+		}
+	}
+}
+
+func (s *FileTokenStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// Get implements TokenStore
+func (s *FileTokenStore) Get(ctx context.Context, id string) ([]byte,
+	error) {
+	fh, err := os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(info, time.Now()) {
+		return nil, nil
+	}
+	return ioutil.ReadAll(fh)
+}
+
+// Put implements TokenStore
+func (s *FileTokenStore) Put(ctx context.Context, id string,
+	data []byte) error {
+	s.sweep(time.Now())
+	// write to a temporary file first so readers never see partial tokens.
+	fh, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), s.path(id))
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+	}
+	return err
+}
+
+// Delete implements TokenStore
+func (s *FileTokenStore) Delete(ctx context.Context, id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,278 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testTokenStore checks the behavior every TokenStore shares.
+func testTokenStore(t *testing.T, store TokenStore) {
+	ctx := context.Background()
+	data, err := store.Get(ctx, "missing")
+	if err != nil || data != nil {
+		t.Fatalf("missing: got %q, %v", data, err)
+	}
+	for _, val := range []string{"first", "second"} {
+		err = store.Put(ctx, "id", []byte(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = store.Get(ctx, "id")
+		if err != nil || string(data) != val {
+			t.Fatalf("got %q, %v, want %q", data, err, val)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		// deleting twice is fine.
+		err = store.Delete(ctx, "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err = store.Get(ctx, "id")
+	if err != nil || data != nil {
+		t.Fatalf("deleted: got %q, %v", data, err)
+	}
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	testTokenStore(t, NewMemoryTokenStore(time.Hour))
+
+	ctx := context.Background()
+	store := NewMemoryTokenStore(time.Hour)
+	data := []byte("token")
+	for _, id := range []string{"old", "new"} {
+		err := store.Put(ctx, id, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the store keeps its own copy.
+	data[0] = 'T'
+	got, err := store.Get(ctx, "new")
+	if err != nil || string(got) != "token" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	entry := store.entries["old"]
+	entry.written = time.Now().Add(-2 * time.Hour)
+	store.entries["old"] = entry
+	got, err = store.Get(ctx, "old")
+	if err != nil || got != nil {
+		t.Fatalf("expired: got %q, %v", got, err)
+	}
+	if len(store.entries) != 2 {
+		t.Fatalf("got %d entries before the sweep", len(store.entries))
+	}
+	// writes sweep out expired entries, but not every time.
+	err = store.Put(ctx, "other", []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.entries) != 3 {
+		t.Fatalf("got %d entries right after a sweep", len(store.entries))
+	}
+	store.last_sweep = time.Now().Add(-tokenSweepInterval)
+	err = store.Put(ctx, "other", []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := store.entries["old"]; exists || len(store.entries) != 2 {
+		t.Fatalf("got entries %v after the sweep", store.entries)
+	}
+
+	// without a max_age, entries are kept until they are deleted.
+	store = NewMemoryTokenStore(0)
+	err = store.Put(ctx, "id", []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry = store.entries["id"]
+	entry.written = time.Now().Add(-24 * 365 * time.Hour)
+	store.entries["id"] = entry
+	got, err = store.Get(ctx, "id")
+	if err != nil || string(got) != "token" {
+		t.Fatalf("no max_age: got %q, %v", got, err)
+	}
+}
+
+func newFileTokenStore(t *testing.T, max_age time.Duration) (
+	store *FileTokenStore, cleanup func()) {
+	dir, err := ioutil.TempDir("", "whoauth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewFileTokenStore(filepath.Join(dir, "tokens"), max_age)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+// files returns the names of the files in the store's directory.
+func (s *FileTokenStore) files(t *testing.T) []string {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestFileTokenStore(t *testing.T) {
+	store, cleanup := newFileTokenStore(t, time.Hour)
+	defer cleanup()
+	testTokenStore(t, store)
+
+	info, err := os.Stat(store.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Fatalf("directory mode %v", info.Mode())
+	}
+
+	ctx := context.Background()
+	err = store.Put(ctx, "id", []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files are named after hashes, so ids never reach the file system, and
+	// no temporary files are left behind.
+	files := store.files(t)
+	if len(files) != 1 || strings.Contains(files[0], "id") ||
+		len(files[0]) != 64 {
+		t.Fatalf("got files %v", files)
+	}
+	info, err = os.Stat(store.path("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("file mode %v", info.Mode())
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(store.path("id"), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(ctx, "id")
+	if err != nil || data != nil {
+		t.Fatalf("expired: got %q, %v", data, err)
+	}
+}
+
+func TestFileTokenStoreSweep(t *testing.T) {
+	store, cleanup := newFileTokenStore(t, time.Hour)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, id := range []string{"old", "new"} {
+		err := store.Put(ctx, id, []byte("token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a temporary file from a write that didn't finish.
+	leftover := filepath.Join(store.dir, ".tmp-leftover")
+	err := ioutil.WriteFile(leftover, []byte("tok"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{store.path("old"), leftover} {
+		err = os.Chtimes(path, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first write already swept, and sweeps are at most once every
+	// tokenSweepInterval.
+	err = store.Put(ctx, "other", []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := store.files(t); len(files) != 4 {
+		t.Fatalf("swept too early, got files %v", files)
+	}
+
+	store.last_sweep = time.Now().Add(-tokenSweepInterval)
+	store.sweep(time.Now())
+	files := store.files(t)
+	if len(files) != 2 {
+		t.Fatalf("got files %v after the sweep", files)
+	}
+	for _, id := range []string{"new", "other"} {
+		data, err := store.Get(ctx, id)
+		if err != nil || string(data) != "token" {
+			t.Fatalf("%s: got %q, %v", id, data, err)
+		}
+	}
+}
+
+func TestFileTokenStoreAtomicPut(t *testing.T) {
+	store, cleanup := newFileTokenStore(t, 0)
+	defer cleanup()
+	ctx := context.Background()
+
+	// readers racing with writers only ever see whole tokens.
+	tokens := [][]byte{
+		bytes.Repeat([]byte("a"), 64<<10),
+		bytes.Repeat([]byte("b"), 128<<10)}
+	err := store.Put(ctx, "id", tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			err := store.Put(ctx, "id", tokens[i%2])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		data, err := store.Get(ctx, "id")
+		if err != nil {
+			t.Error(err)
+			break
+		}
+		if !bytes.Equal(data, tokens[0]) && !bytes.Equal(data, tokens[1]) {
+			t.Errorf("read a partial token of %d bytes", len(data))
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if files := store.files(t); len(files) != 1 {
+		t.Fatalf("got files %v", files)
+	}
+}
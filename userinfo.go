@@ -0,0 +1,208 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	gob.Register(&UserInfo{})
+}
+
+// UserInfo is a provider independent profile of a logged in user.
+type UserInfo struct {
+	// ID is the provider's stable identifier for the user.
+	ID        string
+	Email     string
+	Name      string
+	AvatarURL string
+}
+
+// UserInfoFetcher retrieves the profile of the user that client is
+// authenticated as.
+type UserInfoFetcher func(ctx context.Context, client *http.Client) (
+	*UserInfo, error)
+
+// JSONUserInfo returns a UserInfoFetcher that GETs url and converts the JSON
+// object it returns with mapping. Numbers in the object are json.Numbers.
+func JSONUserInfo(url string,
+	mapping func(fields map[string]interface{}) *UserInfo) UserInfoFetcher {
+	return func(ctx context.Context, client *http.Client) (*UserInfo, error) {
+		fields, err := getFields(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+		info := mapping(fields)
+		if info.ID == "" {
+			return nil, fmt.Errorf("no user id in response from %s", url)
+		}
+		return info, nil
+	}
+}
+
+// OIDCUserInfo returns a UserInfoFetcher for an OpenID Connect userinfo
+// endpoint.
+func OIDCUserInfo(userinfo_url string) UserInfoFetcher {
+	return JSONUserInfo(userinfo_url,
+		func(fields map[string]interface{}) *UserInfo {
+			return &UserInfo{
+				ID:        field(fields, "sub"),
+				Email:     field(fields, "email"),
+				Name:      field(fields, "name"),
+				AvatarURL: field(fields, "picture")}
+		})
+}
+
+// GithubUserInfo returns a UserInfoFetcher for the Github API at api_url,
+// usually https://api.github.com. If the user has no public email address,
+// the primary verified one is looked up, which requires the user:email
+// scope.
+func GithubUserInfo(api_url string) UserInfoFetcher {
+	api_url = strings.TrimRight(api_url, "/")
+	profile := JSONUserInfo(api_url+"/user",
+		func(fields map[string]interface{}) *UserInfo {
+			info := &UserInfo{
+				ID:        field(fields, "id"),
+				Email:     field(fields, "email"),
+				Name:      field(fields, "name"),
+				AvatarURL: field(fields, "avatar_url")}
+			if info.Name == "" {
+				info.Name = field(fields, "login")
+			}
+			return info
+		})
+	return func(ctx context.Context, client *http.Client) (*UserInfo, error) {
+		info, err := profile(ctx, client)
+		if err != nil || info.Email != "" {
+			return info, err
+		}
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		// without the user:email scope this fails, which just leaves the
+		// email address empty.
+		if getJSON(ctx, client, api_url+"/user/emails", &emails) == nil {
+			for _, email := range emails {
+				if email.Primary && email.Verified {
+					info.Email = email.Email
+				}
+			}
+		}
+		return info, nil
+	}
+}
+
+// GoogleUserInfo returns a UserInfoFetcher for Google's OpenID Connect
+// userinfo endpoint. It needs the "openid", "email" and "profile" scopes.
+func GoogleUserInfo() UserInfoFetcher {
+	return OIDCUserInfo("https://openidconnect.googleapis.com/v1/userinfo")
+}
+
+// GitLabUserInfo returns a UserInfoFetcher for the GitLab API at api_url,
+// such as https://gitlab.com/api/v4.
+func GitLabUserInfo(api_url string) UserInfoFetcher {
+	return JSONUserInfo(strings.TrimRight(api_url, "/")+"/user",
+		func(fields map[string]interface{}) *UserInfo {
+			info := &UserInfo{
+				ID:        field(fields, "id"),
+				Email:     field(fields, "email"),
+				Name:      field(fields, "name"),
+				AvatarURL: field(fields, "avatar_url")}
+			// email is only set for the token's own user with read_user.
+			if info.Email == "" {
+				info.Email = field(fields, "public_email")
+			}
+			if info.Name == "" {
+				info.Name = field(fields, "username")
+			}
+			return info
+		})
+}
+
+// GiteaUserInfo returns a UserInfoFetcher for the Gitea or Forgejo API at
+// api_url, such as https://codeberg.org/api/v1.
+func GiteaUserInfo(api_url string) UserInfoFetcher {
+	return JSONUserInfo(strings.TrimRight(api_url, "/")+"/user",
+		func(fields map[string]interface{}) *UserInfo {
+			info := &UserInfo{
+				ID:        field(fields, "id"),
+				Email:     field(fields, "email"),
+				Name:      field(fields, "full_name"),
+				AvatarURL: field(fields, "avatar_url")}
+			if info.Name == "" {
+				info.Name = field(fields, "login")
+			}
+			return info
+		})
+}
+
+// FacebookUserInfo returns a UserInfoFetcher for the Facebook Graph API at
+// api_url, usually https://graph.facebook.com.
+func FacebookUserInfo(api_url string) UserInfoFetcher {
+	return JSONUserInfo(strings.TrimRight(api_url, "/")+
+		"/me?fields=id,name,email,picture",
+		func(fields map[string]interface{}) *UserInfo {
+			info := &UserInfo{
+				ID:    field(fields, "id"),
+				Email: field(fields, "email"),
+				Name:  field(fields, "name")}
+			if picture, ok := fields["picture"].(map[string]interface{}); ok {
+				if data, ok := picture["data"].(map[string]interface{}); ok {
+					info.AvatarURL = field(data, "url")
+				}
+			}
+			return info
+		})
+}
+
+// LinkedInUserInfo returns a UserInfoFetcher for LinkedIn's OpenID Connect
+// userinfo endpoint. It needs the "openid", "email" and "profile" scopes.
+func LinkedInUserInfo() UserInfoFetcher {
+	return OIDCUserInfo("https://api.linkedin.com/v2/userinfo")
+}
+
+// getFields GETs url and decodes the returned JSON object, keeping numbers
+// as json.Numbers so large ids survive.
+func getFields(ctx context.Context, client *http.Client, url string) (
+	map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", url,
+			resp.Status)
+	}
+	var fields map[string]interface{}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	err = dec.Decode(&fields)
+	return fields, err
+}
+
+// field returns fields[name] as a string if it is a string or number.
+func field(fields map[string]interface{}, name string) string {
+	switch val := fields[name].(type) {
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// userInfoServer is a stand-in API that serves the JSON in responses by path
+// to requests with the token "token". Paths without a response are
+// forbidden.
+func userInfoServer(responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			body, ok := responses[r.URL.RequestURI()]
+			if !ok {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, body)
+		}))
+}
+
+func TestUserInfoFetchers(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		fetcher   func(server_url string) UserInfoFetcher
+		responses map[string]string
+		want      *UserInfo
+	}{
+		{"oidc", func(u string) UserInfoFetcher {
+			return OIDCUserInfo(u + "/userinfo")
+		}, map[string]string{
+			"/userinfo": `{"sub": "248289761001", "email": "jane@example.com",
+				"name": "Jane Doe", "picture": "https://example.com/jane.jpg"}`},
+			&UserInfo{ID: "248289761001", Email: "jane@example.com",
+				Name: "Jane Doe", AvatarURL: "https://example.com/jane.jpg"}},
+		{"github public email", GithubUserInfo, map[string]string{
+			"/user": `{"id": 583231, "login": "octocat", "name": "",
+				"email": "octocat@github.com", "avatar_url": "https://a/1"}`},
+			&UserInfo{ID: "583231", Email: "octocat@github.com",
+				Name: "octocat", AvatarURL: "https://a/1"}},
+		{"github private email", GithubUserInfo, map[string]string{
+			"/user": `{"id": 583231, "login": "octocat", "name": "The Octocat",
+				"email": null}`,
+			"/user/emails": `[
+				{"email": "old@github.com", "primary": false, "verified": true},
+				{"email": "octocat@github.com", "primary": true,
+					"verified": true}]`},
+			&UserInfo{ID: "583231", Email: "octocat@github.com",
+				Name: "The Octocat"}},
+		{"github without user:email", GithubUserInfo, map[string]string{
+			"/user": `{"id": 583231, "login": "octocat"}`},
+			&UserInfo{ID: "583231", Name: "octocat"}},
+		{"gitlab", GitLabUserInfo, map[string]string{
+			"/user": `{"id": 1, "username": "john_smith", "name": "",
+				"public_email": "john@example.com",
+				"avatar_url": "https://a/2"}`},
+			&UserInfo{ID: "1", Email: "john@example.com", Name: "john_smith",
+				AvatarURL: "https://a/2"}},
+		{"gitea", GiteaUserInfo, map[string]string{
+			"/user": `{"id": 7, "login": "gitea-user", "full_name": "Gitea User",
+				"email": "user@example.com"}`},
+			&UserInfo{ID: "7", Email: "user@example.com", Name: "Gitea User"}},
+		{"facebook", FacebookUserInfo, map[string]string{
+			"/me?fields=id,name,email,picture": `{"id": "10158",
+				"name": "Mark", "picture": {"data": {"url": "https://a/3"}}}`},
+			&UserInfo{ID: "10158", Name: "Mark", AvatarURL: "https://a/3"}},
+		{"large ids", GithubUserInfo, map[string]string{
+			"/user": `{"id": 12345678901234567890, "login": "big",
+				"email": "big@example.com"}`},
+			&UserInfo{ID: "12345678901234567890", Email: "big@example.com",
+				Name: "big"}},
+		{"no id", GithubUserInfo, map[string]string{
+			"/user": `{"login": "ghost"}`}, nil},
+		{"error status", GiteaUserInfo, map[string]string{}, nil},
+	} {
+		server := userInfoServer(test.responses)
+		ctx := context.Background()
+		client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: "token"}))
+		got, err := test.fetcher(server.URL)(ctx, client)
+		server.Close()
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if *got != *test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+// Package whoauth2dev provides an identity provider for local development,
+// so applications can be run without client secrets for real providers.
+// Users log in by picking one of a list of fake identities. See
+// cmd/whoauth2-devidp for a ready to run server.
+package whoauth2dev // import "gopkg.in/go-webhelp/whoauth2.v1/whoauth2dev"
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/internal/fakeidp"
+)
+
+// Identity is a user a development server offers to log in as.
+type Identity = fakeidp.Identity
+
+// DefaultIdentities are the identities a development server offers when it
+// is given none.
+var DefaultIdentities = []Identity{
+	{Subject: "alice", Email: "alice@example.com", Name: "Alice Example"},
+	{Subject: "bob", Email: "bob@example.com", Name: "Bob Example"}}
+
+// Server is a running development identity provider.
+type Server struct {
+	*fakeidp.IDP
+
+	// URL is the server's base URL and issuer, such as
+	// "http://127.0.0.1:9000".
+	URL string
+
+	server *http.Server
+}
+
+// NewServer starts a development identity provider listening on addr, such as
+// "127.0.0.1:9000". Its URL is the issuer to give Provider. Close it when
+// done.
+func NewServer(addr string, identities ...Identity) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		identities = DefaultIdentities
+	}
+	s := &Server{
+		IDP: fakeidp.New(identities...),
+		URL: "http://" + l.Addr().String()}
+	s.server = &http.Server{Handler: s.IDP}
+	s.SetURL(s.URL)
+	s.SetLoginPage(LoginPage)
+	go s.server.Serve(l)
+	return s, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// Provider returns a Provider for the development server at idp_url. It can
+// be used in a ProviderGroup like any other provider. Only conf's RedirectURL
+// and Scopes are used, since the server accepts fixed client credentials.
+func Provider(conf whoauth2.Config, idp_url string) *whoauth2.Provider {
+	p := fakeidp.ServerProvider("dev", idp_url, conf.RedirectURL)
+	if len(conf.Scopes) > 0 {
+		p.Scopes = conf.Scopes
+	}
+	return p
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Development login</title></head>
+<body>
+<h3>Log in as</h3>
+{{range .Identities}}
+<form method="POST" action="authorize">
+  {{range $name, $vals := $.Form}}{{range $vals}}
+  <input type="hidden" name="{{$name}}" value="{{.}}">
+  {{end}}{{end}}
+  <input type="hidden" name="subject" value="{{.Subject}}">
+  <button type="submit">{{if .Name}}{{.Name}}{{else}}{{.Subject}}{{end}}</button>
+  {{.Email}}
+</form>
+{{end}}
+<form method="POST" action="authorize">
+  {{range $name, $vals := .Form}}{{range $vals}}
+  <input type="hidden" name="{{$name}}" value="{{.}}">
+  {{end}}{{end}}
+  <input type="hidden" name="cancel" value="1">
+  <button type="submit">Cancel</button>
+</form>
+</body>
+</html>
+`))
+
+// LoginPage is the login page development servers use, a list of buttons,
+// one per identity.
+func LoginPage(w http.ResponseWriter, r *http.Request,
+	identities []Identity) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := loginTemplate.Execute(w, map[string]interface{}{
+		"Identities": identities,
+		"Form":       r.Form})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
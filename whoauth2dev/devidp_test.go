@@ -0,0 +1,88 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2dev_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/whoauth2dev"
+)
+
+func TestServer(t *testing.T) {
+	s, err := whoauth2dev.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	conf := whoauth2.Config{RedirectURL: "http://app.example.com/auth/_cb"}
+
+	// the server's URL is its issuer, so discovery works.
+	_, err = whoauth2.Discover(ctx, s.URL, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := whoauth2dev.Provider(conf, s.URL)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	resp, err := client.Get(provider.AuthCodeURL("xyz&<\"state\">"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Alice Example", "bob@example.com",
+		`value="xyz&amp;&lt;&#34;state&#34;&gt;"`} {
+		if !strings.Contains(string(page), want) {
+			t.Fatalf("login page is missing %#v: %s", want, page)
+		}
+	}
+
+	// submit the login page's form for bob.
+	resp, err = client.PostForm(s.URL+"/authorize", url.Values{
+		"client_id":     {provider.ClientID},
+		"redirect_uri":  {provider.RedirectURL},
+		"response_type": {"code"},
+		"state":         {"xyz"},
+		"subject":       {"bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil || location.Query().Get("state") != "xyz" {
+		t.Fatalf("got %s to %v, %v", resp.Status, location, err)
+	}
+	token, err := provider.Exchange(ctx, location.Query().Get("code"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := provider.FetchUserInfo(ctx,
+		oauth2.NewClient(ctx, oauth2.StaticTokenSource(token)))
+	if err != nil || info.ID != "bob" || info.Email != "bob@example.com" {
+		t.Fatalf("got %+v, %v", info, err)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = http.Get(s.URL + "/.well-known/openid-configuration")
+	if err == nil {
+		t.Fatal("server still running after Close")
+	}
+}
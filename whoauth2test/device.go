@@ -0,0 +1,72 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package whoauth2test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/internal/fakeidp"
+)
+
+// DeviceServer is a fake RFC 8628 device authorization server. Device logins
+// stay pending until the test calls Approve or Deny with the user code.
+type DeviceServer struct {
+	*httptest.Server
+	flow fakeidp.DeviceFlow
+}
+
+// NewDeviceServer starts a DeviceServer. Close it when done.
+func NewDeviceServer() *DeviceServer {
+	s := &DeviceServer{}
+	s.flow.Issue = func(user_code string) map[string]interface{} {
+		return map[string]interface{}{
+			"access_token": "device-" + fakeidp.RandomString(),
+			"token_type":   "Bearer",
+			"expires_in":   3600}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/code", s.flow.Authorize)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != fakeidp.DeviceGrantType {
+			fakeidp.WriteError(w, http.StatusBadRequest,
+				"unsupported_grant_type")
+			return
+		}
+		s.flow.Token(w, r)
+	})
+	s.Server = httptest.NewServer(mux)
+	s.flow.VerificationURI = s.URL + "/device"
+	return s
+}
+
+// Provider returns a whoauth2.Provider that uses this server's device
+// authorization and token endpoints.
+func (s *DeviceServer) Provider(name string) *whoauth2.Provider {
+	return &whoauth2.Provider{
+		Name: name,
+		Config: oauth2.Config{
+			ClientID: ClientID,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   s.URL + "/authorize",
+				TokenURL:  s.URL + "/token",
+				AuthStyle: oauth2.AuthStyleInParams}},
+		DeviceAuthURL: s.URL + "/device/code"}
+}
+
+// SetSlowDown makes every new device code answer its first n polls with
+// slow_down.
+func (s *DeviceServer) SetSlowDown(n int) { s.flow.SetSlowDown(n) }
+
+// Approve approves the device login with the given user code.
+func (s *DeviceServer) Approve(user_code string) error {
+	return s.flow.Decide(user_code, true)
+}
+
+// Deny denies the device login with the given user code.
+func (s *DeviceServer) Deny(user_code string) error {
+	return s.flow.Decide(user_code, false)
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+// Package whoauth2test provides fake OAuth2 servers for testing code that
+// uses whoauth2.
+package whoauth2test // import "gopkg.in/go-webhelp/whoauth2.v1/whoauth2test"
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"gopkg.in/go-webhelp/whoauth2.v1"
+	"gopkg.in/go-webhelp/whoauth2.v1/internal/fakeidp"
+)
+
+const (
+	// ClientID and ClientSecret are the client credentials the Server
+	// accepts.
+	ClientID     = fakeidp.ClientID
+	ClientSecret = fakeidp.ClientSecret
+
+	// SubjectCookie is the cookie on the Server that picks which identity
+	// logs in. Without it, the first identity added is used.
+	SubjectCookie = fakeidp.SubjectCookie
+)
+
+// Identity is a user known to the Server.
+type Identity = fakeidp.Identity
+
+// LoginPage renders a page that lets the user pick one of identities. See
+// (*Server).SetLoginPage.
+type LoginPage = fakeidp.LoginPage
+
+// Server is a fake OAuth2 and OpenID Connect provider with authorization,
+// token, userinfo, JWKS, revocation, introspection, device authorization and
+// discovery endpoints. It logs users in without asking, as whichever
+// Identity the SubjectCookie picks. Use Provider to point whoauth2 at it and
+// User to drive logins. The Set methods change how it behaves, and can be
+// called at any time.
+type Server struct {
+	*httptest.Server
+	idp *fakeidp.IDP
+}
+
+// NewServer starts a Server with the given identities. Close it when done.
+func NewServer(identities ...Identity) *Server {
+	s := NewUnstartedServer(identities...)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer makes a Server that isn't listening yet, so that its
+// Listener can be replaced. Call Start when ready and Close when done.
+func NewUnstartedServer(identities ...Identity) *Server {
+	idp := fakeidp.New(identities...)
+	return &Server{Server: httptest.NewUnstartedServer(idp), idp: idp}
+}
+
+// Start starts the Server. Its URL is the issuer.
+func (s *Server) Start() {
+	s.Server.Start()
+	s.idp.SetURL(s.URL)
+}
+
+// SetLoginPage makes the authorization endpoint show page instead of logging
+// users in right away. Users that have the SubjectCookie still skip it.
+func (s *Server) SetLoginPage(page LoginPage) { s.idp.SetLoginPage(page) }
+
+// AddIdentity adds or replaces an identity. The first identity added is the
+// one that logs in when no SubjectCookie is set.
+func (s *Server) AddIdentity(id Identity) { s.idp.AddIdentity(id) }
+
+// SetScopes makes the server grant exactly scopes, whatever was requested.
+// With no scopes, the requested scopes are granted.
+func (s *Server) SetScopes(scopes ...string) { s.idp.SetScopes(scopes...) }
+
+// SetTokenLifetime sets how long issued access tokens are valid. The default
+// is an hour.
+func (s *Server) SetTokenLifetime(lifetime time.Duration) {
+	s.idp.SetTokenLifetime(lifetime)
+}
+
+// SetAuthorizeError makes the authorization endpoint send users back with
+// the OAuth2 error code error_code, such as whoauth2.ErrorAccessDenied. An
+// empty error_code restores normal logins.
+func (s *Server) SetAuthorizeError(error_code string) {
+	s.idp.SetAuthorizeError(error_code)
+}
+
+// SetTokenError makes the token endpoint fail every request with the OAuth2
+// error code error_code, such as "invalid_grant". An empty error_code
+// restores normal token responses.
+func (s *Server) SetTokenError(error_code string) {
+	s.idp.SetTokenError(error_code)
+}
+
+// ExpireTokens expires every access token issued so far on the server's
+// side, so the userinfo and introspection endpoints and Active reject them.
+// Clients still go by the expiry they were issued with and won't refresh
+// because of it. To make clients refresh, issue tokens with a SetTokenLifetime
+// of a few seconds, which golang.org/x/oauth2 already considers expired.
+func (s *Server) ExpireTokens() { s.idp.ExpireTokens() }
+
+// Refreshes returns how many refresh token grants the token endpoint has
+// received.
+func (s *Server) Refreshes() int { return s.idp.Refreshes() }
+
+// Active returns whether access_token was issued by the server and is
+// neither expired nor revoked.
+func (s *Server) Active(access_token string) bool {
+	return s.idp.Active(access_token)
+}
+
+// SetDeviceSlowDown makes every new device code answer its first n polls
+// with slow_down. Device logins are approved with ApproveDevice as the first
+// identity.
+func (s *Server) SetDeviceSlowDown(n int) { s.idp.SetDeviceSlowDown(n) }
+
+// ApproveDevice approves the device login with the given user code.
+func (s *Server) ApproveDevice(user_code string) error {
+	return s.idp.ApproveDevice(user_code)
+}
+
+// DenyDevice denies the device login with the given user code.
+func (s *Server) DenyDevice(user_code string) error {
+	return s.idp.DenyDevice(user_code)
+}
+
+// Sign returns a JWT with claims, signed with the server's key, for tests
+// that need to craft tokens of their own.
+func (s *Server) Sign(claims map[string]interface{}) string {
+	return s.idp.Sign(claims)
+}
+
+// SignAccessToken is like Sign, but marks the JWT as an RFC 9068 access
+// token.
+func (s *Server) SignAccessToken(claims map[string]interface{}) string {
+	return s.idp.SignAccessToken(claims)
+}
+
+// Provider returns a whoauth2.Provider in OIDC mode that uses this server.
+// redirect_url is the provider handler's callback URL, ending in /_cb.
+func (s *Server) Provider(name, redirect_url string) *whoauth2.Provider {
+	return ServerProvider(name, s.URL, redirect_url)
+}
+
+// ServerProvider is like (*Server).Provider for a Server that runs elsewhere,
+// such as in another process, at server_url.
+func ServerProvider(name, server_url, redirect_url string) *whoauth2.Provider {
+	return fakeidp.ServerProvider(name, server_url, redirect_url)
+}
+
+// User is a scripted browser for end-to-end tests. It keeps cookies for the
+// application and the Server, and follows redirects, so fetching a login URL
+// runs the whole login and ends up at the page the user is sent to after.
+type User struct {
+	*http.Client
+}
+
+// User returns a new User that logs in to the server as the identity with
+// subject. An empty subject uses the first identity.
+func (s *Server) User(subject string) *User {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	if subject != "" {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			panic(err)
+		}
+		jar.SetCookies(u, []*http.Cookie{{Name: SubjectCookie, Value: subject}})
+	}
+	return &User{Client: &http.Client{Jar: jar}}
+}
+
+// Login fetches login_url, usually from (*whoauth2.ProviderHandler).LoginURL
+// and absolute, and follows redirects through the provider and the callback.
+// It fails if the final response isn't a 200.
+func (u *User) Login(login_url string) (*http.Response, error) {
+	resp, err := u.Get(login_url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("login ended with %s at %s", resp.Status,
+			resp.Request.URL)
+	}
+	return resp, nil
+}